@@ -0,0 +1,185 @@
+package nessielight
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// status of registerRequest
+const (
+	requestPending  = "pending"
+	requestApproved = "approved"
+	requestRejected = "rejected"
+)
+
+// registration request submitted by an unregistered telegram user
+type RegisterRequest struct {
+	ID         uint
+	TelegramID int
+	Username   string
+	// full name in telegram profile
+	Name      string
+	Note      string
+	CreatedAt time.Time
+}
+
+type registerRequest struct {
+	gorm.Model
+	TelegramID int `gorm:"index"`
+	Username   string
+	Name       string
+	Note       string
+	Status     string `gorm:"index"`
+	// telegram id of the admin handling the request
+	Reviewer int
+}
+
+func (r *registerRequest) view() RegisterRequest {
+	return RegisterRequest{
+		ID:         r.ID,
+		TelegramID: r.TelegramID,
+		Username:   r.Username,
+		Name:       r.Name,
+		Note:       r.Note,
+		CreatedAt:  r.CreatedAt,
+	}
+}
+
+var errRequestHandled = errors.New("request is not found or already handled")
+
+// TelegramAuthService accepting both tokens and registration requests approved by admins
+type approvalTelegramAuthService struct {
+	simpleTelegramAuthService
+	preset UserPreset
+}
+
+func (r *approvalTelegramAuthService) SubmitRequest(req RegisterRequest) (RegisterRequest, error) {
+	user, err := (*r.userManager).FindUserByTelegramID(req.TelegramID)
+	if err != nil {
+		return RegisterRequest{}, err
+	}
+	if user != nil {
+		return RegisterRequest{}, errors.New("you've already registered")
+	}
+	var count int64
+	if err := DataBase.Model(&registerRequest{}).
+		Where("telegram_id = ? AND status = ?", req.TelegramID, requestPending).
+		Count(&count).Error; err != nil {
+		return RegisterRequest{}, err
+	}
+	if count > 0 {
+		return RegisterRequest{}, errors.New("you already have a pending request")
+	}
+	record := registerRequest{
+		TelegramID: req.TelegramID,
+		Username:   req.Username,
+		Name:       req.Name,
+		Note:       req.Note,
+		Status:     requestPending,
+	}
+	if err := DataBase.Create(&record).Error; err != nil {
+		return RegisterRequest{}, err
+	}
+	authLog.Printf("user %d requests registration, request %d", req.TelegramID, record.ID)
+	return record.view(), nil
+}
+
+func (r *approvalTelegramAuthService) PendingRequests() ([]RegisterRequest, error) {
+	var records []registerRequest
+	if err := DataBase.Where("status = ?", requestPending).Order("id").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	requests := make([]RegisterRequest, 0, len(records))
+	for _, v := range records {
+		requests = append(requests, v.view())
+	}
+	return requests, nil
+}
+
+// mark a pending request as handled by admin. A single conditional update, so
+// a request cannot be handled twice by concurrent admins
+func (r *approvalTelegramAuthService) handle(id uint, admin int, status string) (registerRequest, error) {
+	var record registerRequest
+	res := DataBase.Model(&registerRequest{}).
+		Where("id = ? AND status = ?", id, requestPending).
+		Updates(map[string]interface{}{"status": status, "reviewer": admin})
+	if res.Error != nil {
+		return record, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return record, errRequestHandled
+	}
+	if err := DataBase.First(&record, id).Error; err != nil {
+		return record, err
+	}
+	return record, nil
+}
+
+func (r *approvalTelegramAuthService) Approve(id uint, admin int) (User, RegisterRequest, error) {
+	record, err := r.handle(id, admin, requestApproved)
+	if err != nil {
+		return nil, RegisterRequest{}, err
+	}
+	user, err := r.approve(&record)
+	if err != nil {
+		if user == nil {
+			// not registered, let the request be handled again
+			DataBase.Model(&record).Updates(map[string]interface{}{"status": requestPending, "reviewer": 0})
+		}
+		return user, record.view(), err
+	}
+	authLog.Printf("user %d registered by request %d, approved by %d", record.TelegramID, record.ID, admin)
+	return user, record.view(), nil
+}
+
+// register the requester like Register does and provision proxies. user is
+// not nil if registered, even if provisioning fails
+func (r *approvalTelegramAuthService) approve(record *registerRequest) (User, error) {
+	exist, err := (*r.userManager).FindUserByTelegramID(record.TelegramID)
+	if err != nil {
+		return nil, err
+	}
+	if exist != nil {
+		return exist, fmt.Errorf("user %d has already registered", record.TelegramID)
+	}
+	user, err := r.newUser(record.TelegramID, r.preset)
+	if err != nil {
+		return nil, err
+	}
+	if err := user.SetName(record.Username); err != nil {
+		return user, err
+	}
+	if err := user.SetProxy(NewUserProxies()); err != nil {
+		return user, err
+	}
+	if err := ApplyUserProxy(user); err != nil {
+		return user, err
+	}
+	if err := (*r.userManager).SetUser(user); err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+func (r *approvalTelegramAuthService) Reject(id uint, admin int) (RegisterRequest, error) {
+	record, err := r.handle(id, admin, requestRejected)
+	if err != nil {
+		return RegisterRequest{}, err
+	}
+	authLog.Printf("request %d of user %d rejected by %d", record.ID, record.TelegramID, admin)
+	return record.view(), nil
+}
+
+// users can also register by requests approved by admins, which are
+// registered with preset
+func InitApprovalAuthService(preset UserPreset) {
+	AuthServiceInstance = &approvalTelegramAuthService{
+		simpleTelegramAuthService: simpleTelegramAuthService{userManager: &UserManagerInstance},
+		preset:                    preset,
+	}
+}
+
+var _ RegistrationApprover = (*approvalTelegramAuthService)(nil)
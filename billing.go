@@ -0,0 +1,135 @@
+package nessielight
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// day of month when billing cycles start, used by users without their own
+// cycle day. 0 disables automatic traffic reset
+var BillingCycleDay int
+
+// traffic of a user in a finished billing cycle
+type trafficCycle struct {
+	gorm.Model
+	UserID int `gorm:"index"`
+	Start  time.Time
+	End    time.Time
+	TrafficValue
+}
+
+type TrafficCycle struct {
+	// zero if traffic was counted since registration
+	Start, End time.Time
+	TrafficValue
+}
+
+// start of the billing cycle containing now. Days after the end of a short
+// month are treated as its last day
+func cycleStart(day int, now time.Time) time.Time {
+	start := func(year int, month time.Month) time.Time {
+		last := time.Date(year, month+1, 0, 0, 0, 0, 0, now.Location()).Day()
+		d := day
+		if d > last {
+			d = last
+		}
+		return time.Date(year, month, d, 0, 0, 0, 0, now.Location())
+	}
+	if s := start(now.Year(), now.Month()); !s.After(now) {
+		return s
+	}
+	return start(now.Year(), now.Month()-1)
+}
+
+// cycle day of a user, falling back to BillingCycleDay
+func userCycleDay(user User) int {
+	if day := user.CycleDay(); day > 0 {
+		return day
+	}
+	return BillingCycleDay
+}
+
+// archive traffic of the current cycle, which ends at end, and start a new cycle
+func ResetUserTraffic(user User, end time.Time) error {
+	trafficMu.Lock()
+	defer trafficMu.Unlock()
+	cycle := trafficCycle{
+		UserID: user.TelegramID(),
+		Start:  user.CycleStart(),
+		End:    end,
+	}
+	if err := user.SetCycleStart(end); err != nil {
+		return err
+	}
+	err := DataBase.Transaction(func(tx *gorm.DB) error {
+		// traffic of user may be stale, archive the stored one
+		err := tx.Model(&simpleUser{}).Select("uplink", "downlink").
+			Where("registerid = ?", user.TelegramID()).Scan(&cycle.TrafficValue).Error
+		if err != nil {
+			return err
+		}
+		if err := user.SetTraffic(TrafficValue{}); err != nil {
+			return err
+		}
+		if err := tx.Create(&cycle).Error; err != nil {
+			return err
+		}
+		err = tx.Model(&simpleUser{}).Where("registerid = ?", user.TelegramID()).
+			Updates(map[string]interface{}{"uplink": 0, "downlink": 0}).Error
+		if err != nil {
+			return err
+		}
+		return saveUser(tx, user)
+	})
+	if err != nil {
+		return err
+	}
+	logger.Printf("reset traffic of user %d, cycle %v - %v: %v", user.TelegramID(), cycle.Start, cycle.End, cycle.TrafficValue)
+	// resume users suspended by quota
+	return EnforceQuota(user)
+}
+
+// reset traffic of users whose billing cycle has ended
+func CheckBillingCycles(now time.Time) error {
+	users, err := UserManagerInstance.All()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		day := userCycleDay(user)
+		if day <= 0 {
+			continue
+		}
+		start := cycleStart(day, now)
+		if user.CycleStart().IsZero() {
+			// first cycle of the user, traffic before it is counted in this cycle
+			if err := user.SetCycleStart(start); err != nil {
+				return err
+			}
+			if err := UserManagerInstance.SetUser(user); err != nil {
+				return err
+			}
+			continue
+		}
+		if user.CycleStart().Before(start) {
+			if err := ResetUserTraffic(user, start); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// latest finished billing cycles of a user, newest first
+func UserCycles(tid int, limit int) ([]TrafficCycle, error) {
+	var cycles []trafficCycle
+	if err := DataBase.Where("user_id = ?", tid).Order("id desc").Limit(limit).Find(&cycles).Error; err != nil {
+		return nil, err
+	}
+	res := make([]TrafficCycle, len(cycles))
+	for i, v := range cycles {
+		res[i] = TrafficCycle{Start: v.Start, End: v.End, TrafficValue: v.TrafficValue}
+	}
+	return res, nil
+}
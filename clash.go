@@ -0,0 +1,217 @@
+package nessielight
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// rules of clash profiles. Proxy rules should target ClashProxyGroup
+var ClashRules = []string{
+	"GEOIP,LAN,DIRECT",
+	"GEOIP,CN,DIRECT",
+	"MATCH," + ClashProxyGroup,
+}
+
+// name of the proxy group containing all proxies of a user
+const ClashProxyGroup = "Proxy"
+
+// load clash rules from a file, one rule per line. Empty lines and lines
+// starting with # are ignored
+func LoadClashRules(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var rules []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules = append(rules, line)
+	}
+	return rules, scanner.Err()
+}
+
+// YAML is a superset of JSON, so values are written as JSON flow nodes
+var clashTemplate = template.Must(template.New("clash").Funcs(template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}).Parse(`# clash profile of {{json .User}}
+mixed-port: 7890
+allow-lan: false
+mode: rule
+log-level: info
+proxies:
+{{- range .Proxies}}
+  - {{json .}}
+{{- end}}
+proxy-groups:
+  - name: {{json .Group}}
+    type: select
+    proxies: {{json .Names}}
+rules:
+{{- range .Rules}}
+  - {{json .}}
+{{- end}}
+`))
+
+// clash proxy of an endpoint. Clash does not support kcp, and its trojan requires TLS,
+// so ok is false for such endpoints. vless is only supported by Clash.Meta
+func clashProxy(e ProxyEndpoint, meta bool) (proxy map[string]interface{}, ok bool) {
+	proxy = map[string]interface{}{
+		"name":   e.Name,
+		"server": e.Server,
+		"port":   e.Port,
+		"udp":    true,
+	}
+	switch e.Protocol {
+	case "vmess":
+		proxy["type"] = "vmess"
+		proxy["uuid"] = e.ID
+		proxy["alterId"] = 0
+		proxy["cipher"] = "auto"
+	case "vless":
+		// vanilla clash rejects the whole profile on unknown proxy types
+		if !meta {
+			return nil, false
+		}
+		proxy["type"] = "vless"
+		proxy["uuid"] = e.ID
+	case "trojan":
+		if !e.TLS || (e.Network != "ws" && e.Network != "grpc") {
+			return nil, false
+		}
+		proxy["type"] = "trojan"
+		proxy["password"] = e.Password
+		proxy["sni"] = e.Server
+	case "shadowsocks":
+		proxy["type"] = "ss"
+		proxy["cipher"] = e.Cipher
+		proxy["password"] = e.Password
+		if e.Plugin != "" {
+			plugin, opts, ok := clashPlugin(e.Plugin)
+			if !ok {
+				return nil, false
+			}
+			proxy["plugin"] = plugin
+			proxy["plugin-opts"] = opts
+		}
+		return proxy, true
+	default:
+		return nil, false
+	}
+	if e.TLS && e.Protocol != "trojan" {
+		proxy["tls"] = true
+		proxy["servername"] = e.Server
+	}
+	switch e.Network {
+	case "ws":
+		proxy["network"] = "ws"
+		proxy["ws-opts"] = map[string]interface{}{
+			"path":    e.Path,
+			"headers": map[string]string{"Host": e.Host},
+		}
+	case "grpc":
+		proxy["network"] = "grpc"
+		proxy["grpc-opts"] = map[string]string{"grpc-service-name": e.ServiceName}
+	case "h2":
+		proxy["network"] = "h2"
+		proxy["h2-opts"] = map[string]interface{}{
+			"host": []string{e.Host},
+			"path": e.Path,
+		}
+	case "tcp":
+		if e.HeaderType == "http" {
+			path := e.Path
+			if path == "" {
+				path = "/"
+			}
+			proxy["network"] = "http"
+			proxy["http-opts"] = map[string]interface{}{
+				"method":  "GET",
+				"path":    []string{path},
+				"headers": map[string][]string{"Host": {e.Host}},
+			}
+		}
+	default:
+		return nil, false
+	}
+	return proxy, true
+}
+
+// translate SIP003 plugin string like "obfs-local;obfs=http;obfs-host=example.com"
+func clashPlugin(plugin string) (name string, opts map[string]interface{}, ok bool) {
+	items := strings.Split(plugin, ";")
+	args := make(map[string]string)
+	for _, item := range items[1:] {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) == 2 {
+			args[kv[0]] = kv[1]
+		} else {
+			args[kv[0]] = ""
+		}
+	}
+	switch items[0] {
+	case "obfs-local", "simple-obfs":
+		return "obfs", map[string]interface{}{"mode": args["obfs"], "host": args["obfs-host"]}, true
+	case "v2ray-plugin":
+		_, tls := args["tls"]
+		mode := args["mode"]
+		if mode == "" {
+			mode = "websocket"
+		}
+		opts = map[string]interface{}{"mode": mode, "tls": tls}
+		if host, ok := args["host"]; ok {
+			opts["host"] = host
+		}
+		if path, ok := args["path"]; ok {
+			opts["path"] = path
+		}
+		return "v2ray-plugin", opts, true
+	}
+	return "", nil, false
+}
+
+// clash profile containing all proxies of a user, which clash does not support are left out
+func ClashConfig(user User) (string, error) {
+	return clashConfig(user, false)
+}
+
+// like ClashConfig, but for Clash.Meta, which also supports vless
+func ClashMetaConfig(user User) (string, error) {
+	return clashConfig(user, true)
+}
+
+func clashConfig(user User, meta bool) (string, error) {
+	var proxies []map[string]interface{}
+	var names []string
+	for _, e := range UserEndpoints(user) {
+		proxy, ok := clashProxy(e, meta)
+		if !ok {
+			continue
+		}
+		proxies = append(proxies, proxy)
+		names = append(names, e.Name)
+	}
+	if len(names) == 0 {
+		names = []string{"DIRECT"}
+	}
+	var b bytes.Buffer
+	err := clashTemplate.Execute(&b, map[string]interface{}{
+		"User":    user.Name(),
+		"Proxies": proxies,
+		"Group":   ClashProxyGroup,
+		"Names":   names,
+		"Rules":   ClashRules,
+	})
+	return b.String(), err
+}
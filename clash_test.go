@@ -0,0 +1,21 @@
+package nessielight
+
+import "testing"
+
+func TestClashConfig(t *testing.T) {
+	user := initTestEndpoints(t)
+	tests := []struct {
+		golden   string
+		generate func(User) (string, error)
+	}{
+		{"clash.yaml", ClashConfig},
+		{"clashmeta.yaml", ClashMetaConfig},
+	}
+	for _, tt := range tests {
+		config, err := tt.generate(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, tt.golden, config)
+	}
+}
@@ -0,0 +1,231 @@
+package nessielight
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// local inbounds of generated client configs
+const (
+	clientListen    = "127.0.0.1"
+	clientSocksPort = 1080
+	clientHTTPPort  = 1081
+)
+
+type jsonObject = map[string]interface{}
+
+// sing-box outbound of an endpoint. sing-box supports neither kcp nor the
+// http header of tcp, so ok is false for such endpoints
+func singBoxOutbound(e ProxyEndpoint) (outbound jsonObject, ok bool) {
+	outbound = jsonObject{
+		"tag":         e.Name,
+		"server":      e.Server,
+		"server_port": e.Port,
+	}
+	switch e.Protocol {
+	case "vmess":
+		outbound["type"] = "vmess"
+		outbound["uuid"] = e.ID
+		outbound["security"] = "auto"
+		outbound["alter_id"] = 0
+	case "vless":
+		outbound["type"] = "vless"
+		outbound["uuid"] = e.ID
+	case "trojan":
+		outbound["type"] = "trojan"
+		outbound["password"] = e.Password
+	case "shadowsocks":
+		outbound["type"] = "shadowsocks"
+		outbound["method"] = e.Cipher
+		outbound["password"] = e.Password
+		if e.Plugin != "" {
+			// SIP003 plugin string is "name;options"
+			items := strings.SplitN(e.Plugin, ";", 2)
+			outbound["plugin"] = items[0]
+			if len(items) == 2 {
+				outbound["plugin_opts"] = items[1]
+			}
+		}
+		return outbound, true
+	default:
+		return nil, false
+	}
+	if e.TLS {
+		outbound["tls"] = jsonObject{"enabled": true, "server_name": e.Server}
+	}
+	switch e.Network {
+	case "ws":
+		outbound["transport"] = jsonObject{"type": "ws", "path": e.Path, "headers": jsonObject{"Host": e.Host}}
+	case "grpc":
+		outbound["transport"] = jsonObject{"type": "grpc", "service_name": e.ServiceName}
+	case "h2":
+		outbound["transport"] = jsonObject{"type": "http", "host": []string{e.Host}, "path": e.Path}
+	case "tcp":
+		if e.HeaderType == "http" {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	return outbound, true
+}
+
+// sing-box config.json with local socks and http inbounds. Private addresses
+// are connected directly, other traffic goes through a selector of all proxies
+func SingBoxConfig(user User) (string, error) {
+	var tags []string
+	var proxies []interface{}
+	for _, e := range UserEndpoints(user) {
+		if outbound, ok := singBoxOutbound(e); ok {
+			proxies = append(proxies, outbound)
+			tags = append(tags, e.Name)
+		}
+	}
+	tags = append(tags, "direct")
+	outbounds := append([]interface{}{
+		jsonObject{"type": "selector", "tag": "proxy", "outbounds": tags},
+	}, proxies...)
+	outbounds = append(outbounds,
+		jsonObject{"type": "direct", "tag": "direct"},
+		jsonObject{"type": "block", "tag": "block"},
+	)
+	config := jsonObject{
+		"log": jsonObject{"level": "info"},
+		"inbounds": []interface{}{
+			jsonObject{"type": "socks", "tag": "socks-in", "listen": clientListen, "listen_port": clientSocksPort},
+			jsonObject{"type": "http", "tag": "http-in", "listen": clientListen, "listen_port": clientHTTPPort},
+		},
+		"outbounds": outbounds,
+		"route": jsonObject{
+			"rules": []interface{}{
+				jsonObject{"ip_is_private": true, "outbound": "direct"},
+			},
+			"final": "proxy",
+		},
+	}
+	b, err := json.MarshalIndent(config, "", "  ")
+	return string(b), err
+}
+
+// v2ray outbound of an endpoint. v2ray does not run SIP003 plugins, so ok is
+// false for shadowsocks with plugin
+func v2rayOutbound(e ProxyEndpoint, tag string) (outbound jsonObject, ok bool) {
+	outbound = jsonObject{"tag": tag}
+	switch e.Protocol {
+	case "vmess":
+		outbound["protocol"] = "vmess"
+		outbound["settings"] = jsonObject{"vnext": []interface{}{jsonObject{
+			"address": e.Server,
+			"port":    e.Port,
+			"users":   []interface{}{jsonObject{"id": e.ID, "alterId": 0, "security": "auto"}},
+		}}}
+	case "vless":
+		outbound["protocol"] = "vless"
+		outbound["settings"] = jsonObject{"vnext": []interface{}{jsonObject{
+			"address": e.Server,
+			"port":    e.Port,
+			"users":   []interface{}{jsonObject{"id": e.ID, "encryption": "none"}},
+		}}}
+	case "trojan":
+		outbound["protocol"] = "trojan"
+		outbound["settings"] = jsonObject{"servers": []interface{}{jsonObject{
+			"address":  e.Server,
+			"port":     e.Port,
+			"password": e.Password,
+		}}}
+	case "shadowsocks":
+		if e.Plugin != "" {
+			return nil, false
+		}
+		outbound["protocol"] = "shadowsocks"
+		outbound["settings"] = jsonObject{"servers": []interface{}{jsonObject{
+			"address":  e.Server,
+			"port":     e.Port,
+			"method":   e.Cipher,
+			"password": e.Password,
+		}}}
+		return outbound, true
+	default:
+		return nil, false
+	}
+	stream := jsonObject{"security": "none"}
+	if e.TLS {
+		stream["security"] = "tls"
+		stream["tlsSettings"] = jsonObject{"serverName": e.Server}
+	}
+	switch e.Network {
+	case "ws":
+		stream["network"] = "ws"
+		stream["wsSettings"] = jsonObject{"path": e.Path, "headers": jsonObject{"Host": e.Host}}
+	case "grpc":
+		stream["network"] = "grpc"
+		stream["grpcSettings"] = jsonObject{"serviceName": e.ServiceName}
+	case "h2":
+		stream["network"] = "http"
+		stream["httpSettings"] = jsonObject{"host": []string{e.Host}, "path": e.Path}
+	case "tcp":
+		stream["network"] = "tcp"
+		if e.HeaderType == "http" {
+			path := e.Path
+			if path == "" {
+				path = "/"
+			}
+			stream["tcpSettings"] = jsonObject{"header": jsonObject{
+				"type": "http",
+				"request": jsonObject{
+					"path":    []string{path},
+					"headers": jsonObject{"Host": []string{e.Host}},
+				},
+			}}
+		}
+	case "kcp":
+		stream["network"] = "kcp"
+		kcp := jsonObject{"header": jsonObject{"type": e.linkType()}}
+		if e.Seed != "" {
+			kcp["seed"] = e.Seed
+		}
+		stream["kcpSettings"] = kcp
+	default:
+		return nil, false
+	}
+	outbound["streamSettings"] = stream
+	return outbound, true
+}
+
+// v2ray/v2fly client config.json with local socks and http inbounds. Private
+// addresses are connected directly, other traffic is balanced among all proxies
+func V2rayClientConfig(user User) (string, error) {
+	var outbounds []interface{}
+	for _, e := range UserEndpoints(user) {
+		if outbound, ok := v2rayOutbound(e, "proxy-"+e.Name); ok {
+			outbounds = append(outbounds, outbound)
+		}
+	}
+	routing := jsonObject{
+		"domainStrategy": "IPIfNonMatch",
+		"rules": []interface{}{
+			jsonObject{"type": "field", "ip": []string{"geoip:private"}, "outboundTag": "direct"},
+		},
+	}
+	// a balancer needs outbounds, so without proxies freedom is the default
+	if len(outbounds) > 0 {
+		routing["balancers"] = []interface{}{
+			jsonObject{"tag": "proxy", "selector": []string{"proxy-"}},
+		}
+		routing["rules"] = append(routing["rules"].([]interface{}),
+			jsonObject{"type": "field", "network": "tcp,udp", "balancerTag": "proxy"})
+	}
+	outbounds = append(outbounds, jsonObject{"protocol": "freedom", "tag": "direct"})
+	config := jsonObject{
+		"log": jsonObject{"loglevel": "warning"},
+		"inbounds": []interface{}{
+			jsonObject{"tag": "socks-in", "protocol": "socks", "listen": clientListen, "port": clientSocksPort,
+				"settings": jsonObject{"udp": true}},
+			jsonObject{"tag": "http-in", "protocol": "http", "listen": clientListen, "port": clientHTTPPort},
+		},
+		"outbounds": outbounds,
+		"routing":   routing,
+	}
+	b, err := json.MarshalIndent(config, "", "  ")
+	return string(b), err
+}
@@ -0,0 +1,82 @@
+package nessielight
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// user with a vmess, vless, trojan and shadowsocks proxy, served by a v2ray
+// client without connections
+func initTestEndpoints(t *testing.T) User {
+	t.Helper()
+	initTestDB(t)
+	vmess, err := ParseInboundOptions("", 10001, "/vmess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vless, err := ParseInboundOptions("network=grpc&serviceName=nessie", 10002, "/vless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trojan, err := ParseInboundOptions("", 10003, "/trojan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	V2rayServiceInstance = &v2rayClient{
+		inboundTag: "vmess",
+		vmess:      vmess,
+		clientport: 443,
+		domain:     "example.com",
+		vlessTag:   "vless",
+		vless:      vless,
+		trojanTag:  "trojan",
+		trojan:     trojan,
+		ssTag:      "ss",
+		ssCipher:   "aes-128-gcm",
+	}
+	proxies := []Proxy{
+		&v2rayProxy{Uuid: "7d5d4a35-6bda-4c4c-8c5b-3b3e5a1c2f01"},
+		&vlessProxy{Uuid: "0b6e0f4e-2f7c-4a3e-9d59-1b1c0c1f4a02"},
+		&trojanProxy{Password: "trojan-password"},
+		&shadowsocksProxy{Port: 20000, Cipher: "aes-128-gcm", Password: "ss-password"},
+	}
+	for _, p := range proxies {
+		if err := DataBase.Create(p).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	user := UserManagerInstance.NewUser(1001)
+	// a name breaking out of the comment of clash profiles
+	if err := user.SetName("alice\nmixed-port: 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := user.SetProxy(proxies); err != nil {
+		t.Fatal(err)
+	}
+	if err := UserManagerInstance.SetUser(user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// compare with testdata/name
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	want, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s mismatch, got:\n%s", name, got)
+	}
+}
+
+func TestSingBoxConfig(t *testing.T) {
+	user := initTestEndpoints(t)
+	config, err := SingBoxConfig(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "singbox.json", config)
+}
@@ -0,0 +1,95 @@
+package nessielight
+
+import "fmt"
+
+// connection parameters of a proxy, from which client configs are generated
+type ProxyEndpoint struct {
+	// vmess, vless, trojan or shadowsocks
+	Protocol string
+	// unique among proxies of a user
+	Name   string
+	Server string
+	Port   int
+	// uuid of vmess and vless
+	ID string
+	// password of trojan and shadowsocks
+	Password string
+	// cipher and SIP003 plugin of shadowsocks
+	Cipher string
+	Plugin string
+	TLS    bool
+	// Host defaults to Server
+	Transport
+}
+
+// implemented by proxies which can be described as ProxyEndpoint
+type endpointer interface {
+	endpoint() ProxyEndpoint
+}
+
+// endpoints of proxies of a user
+func UserEndpoints(user User) []ProxyEndpoint {
+	var endpoints []ProxyEndpoint
+	for _, p := range user.Proxy() {
+		if e, ok := p.(endpointer); ok {
+			endpoints = append(endpoints, e.endpoint())
+		}
+	}
+	return endpoints
+}
+
+// name of a proxy in links and client profiles, which must not contain its
+// secret since clients display it
+func proxyName(domain, protocol string, id uint) string {
+	return fmt.Sprintf("%s_%s_%d", domain, protocol, id)
+}
+
+// endpoint of a proxy served by a managed inbound
+func (r *v2rayClient) inboundEndpoint(protocol string, opt InboundOptions, id uint) ProxyEndpoint {
+	e := ProxyEndpoint{
+		Protocol:  protocol,
+		Name:      proxyName(r.domain, protocol, id),
+		Server:    r.domain,
+		Port:      opt.clientPort(r.clientport),
+		TLS:       opt.tls(),
+		Transport: opt.Transport,
+	}
+	if e.Host == "" {
+		e.Host = r.domain
+	}
+	return e
+}
+
+func (r *v2rayProxy) endpoint() ProxyEndpoint {
+	client := V2rayServiceInstance.(*v2rayClient)
+	e := client.inboundEndpoint("vmess", client.vmess, r.ID)
+	e.ID = r.Uuid
+	return e
+}
+
+func (r *vlessProxy) endpoint() ProxyEndpoint {
+	client := V2rayServiceInstance.(*v2rayClient)
+	e := client.inboundEndpoint("vless", client.vless, r.ID)
+	e.ID = r.Uuid
+	return e
+}
+
+func (r *trojanProxy) endpoint() ProxyEndpoint {
+	client := V2rayServiceInstance.(*v2rayClient)
+	e := client.inboundEndpoint("trojan", client.trojan, r.ID)
+	e.Password = r.Password
+	return e
+}
+
+func (r *shadowsocksProxy) endpoint() ProxyEndpoint {
+	client := V2rayServiceInstance.(*v2rayClient)
+	return ProxyEndpoint{
+		Protocol: "shadowsocks",
+		Name:     proxyName(client.domain, "shadowsocks", r.ID),
+		Server:   client.domain,
+		Port:     int(r.Port),
+		Password: r.Password,
+		Cipher:   r.Cipher,
+		Plugin:   client.ssPlugin,
+	}
+}
@@ -0,0 +1,102 @@
+package nessielight
+
+import (
+	"strconv"
+	"time"
+)
+
+// preference keeping the expiry a reminder has been sent for, as unix time
+const prefExpiryReminded = "expiry_reminded"
+
+// whether the account of user has expired at now
+func Expired(user User, now time.Time) bool {
+	expiry := user.Expiry()
+	return !expiry.IsZero() && !now.Before(expiry)
+}
+
+// suspend an expired user, or resume a user suspended by expiry once the
+// expiry is extended. A resumed user exceeding quota is suspended by quota
+// instead. The user is saved if changed
+func EnforceExpiry(user User, now time.Time) error {
+	expired := Expired(user, now)
+	switch {
+	case expired && user.Suspension() != SuspendedByExpiry:
+		// proxies of users suspended by quota are already deactivated
+		if user.Suspension() == "" {
+			for _, p := range user.Proxy() {
+				if err := p.Deactivate(); err != nil {
+					logger.Printf("EnforceExpiry: deactivate proxy %d of user %d: %s", p.ProxyID(), user.TelegramID(), err.Error())
+				}
+			}
+		}
+		if err := user.SetSuspension(SuspendedByExpiry); err != nil {
+			return err
+		}
+		logger.Printf("user %d is suspended, expired at %v", user.TelegramID(), user.Expiry())
+		if err := UserManagerInstance.SetUser(user); err != nil {
+			return err
+		}
+		Notify(user, EventSuspended, NotifyData{})
+	case !expired && user.Suspension() == SuspendedByExpiry:
+		if user.Quota().Exceeded(user.Traffic()) {
+			if err := user.SetSuspension(SuspendedByQuota); err != nil {
+				return err
+			}
+			logger.Printf("user %d is extended to %v, but still suspended by quota", user.TelegramID(), user.Expiry())
+			return UserManagerInstance.SetUser(user)
+		}
+		if err := user.SetSuspension(""); err != nil {
+			return err
+		}
+		if err := UserManagerInstance.SetUser(user); err != nil {
+			return err
+		}
+		logger.Printf("user %d is resumed, expires at %v", user.TelegramID(), user.Expiry())
+		return ApplyUserProxy(user)
+	}
+	return nil
+}
+
+// enforce expiry of all users
+func CheckExpiry(now time.Time) error {
+	users, err := UserManagerInstance.All()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := EnforceExpiry(user, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// users expiring within before, who have not been reminded of their current
+// expiry. Mark them by SetExpiryReminded after reminding
+func DueExpiryReminders(now time.Time, before time.Duration) ([]User, error) {
+	users, err := UserManagerInstance.All()
+	if err != nil {
+		return nil, err
+	}
+	var due []User
+	for _, user := range users {
+		expiry := user.Expiry()
+		if expiry.IsZero() || Expired(user, now) || expiry.Sub(now) > before {
+			continue
+		}
+		if user.Preference(prefExpiryReminded) == strconv.FormatInt(expiry.Unix(), 10) {
+			continue
+		}
+		due = append(due, user)
+	}
+	return due, nil
+}
+
+// record that user has been reminded of the current expiry, so extending the
+// expiry enables another reminder
+func SetExpiryReminded(user User) error {
+	if err := user.SetPreference(prefExpiryReminded, strconv.FormatInt(user.Expiry().Unix(), 10)); err != nil {
+		return err
+	}
+	return UserManagerInstance.SetUser(user)
+}
@@ -1,5 +1,7 @@
 package nessielight
 
+import "time"
+
 // Interface for User. Typically implemented by UserManager.NewUser
 type User interface {
 	TelegramID() int
@@ -7,9 +9,37 @@ type User interface {
 	Proxy() []Proxy
 	SetProxy(proxy []Proxy) error
 	SetName(name string) error
-	// total traffic stored
+	// total traffic stored. It is not saved by UserManager.SetUser, see
+	// V2rayUpdateUserTraffic and ResetUserTraffic
 	Traffic() TrafficValue
 	SetTraffic(val TrafficValue) error
+	Quota() TrafficQuota
+	SetQuota(quota TrafficQuota) error
+	// reason of suspension such as SuspendedByQuota, empty if the user is active.
+	// Proxies of suspended users are deactivated
+	Suspension() string
+	SetSuspension(reason string) error
+	// day of month when billing cycles of the user start, 0 for BillingCycleDay
+	CycleDay() int
+	SetCycleDay(day int) error
+	// start of the current billing cycle, zero if not started yet
+	CycleStart() time.Time
+	SetCycleStart(t time.Time) error
+	// secret in subscription url, empty if not generated yet
+	SubscriptionToken() string
+	SetSubscriptionToken(token string) error
+	// preference such as PrefProxyFormat, empty if not set
+	Preference(key string) string
+	SetPreference(key, value string) error
+	// when the account expires, zero for never
+	Expiry() time.Time
+	SetExpiry(t time.Time) error
+	// group of the user set by admins, empty for none
+	Group() string
+	SetGroup(group string) error
+	// notes about the user, only visible to admins
+	Notes() string
+	SetNotes(notes string) error
 }
 
 // implemented by simpleUserManager
@@ -19,8 +49,10 @@ type UserManager interface {
 	DeleteUser(user User) error
 	// find user by id, nil for not found
 	FindUserByTelegramID(tid int) (User, error)
-	// find user by proxy id, nil for not found
-	FindUserByProxy(proxyid uint) (User, error)
+	// find user by proxy type and id, nil for not found
+	FindUserByProxy(proxytype string, proxyid uint) (User, error)
+	// find user by subscription token, nil for not found
+	FindUserBySubscriptionToken(token string) (User, error)
 	// generate new user by id
 	NewUser(tid int) User
 	All() ([]User, error)
@@ -36,31 +68,67 @@ type V2rayService interface {
 	// query traffic for user under control only
 	QueryUserTraffic(reset bool) (stat []V2rayTrafficStat, err error)
 	Start(listen string) error
-	VmessText(vmessid string) string
-	VmessLink(vmessid string) string
+	VmessText(id uint, vmessid string) string
+	VmessLink(id uint, vmessid string) string
 	NewProxy() Proxy
-	AddVmessWsInbound(tag string, port uint16, wspath string) error
+	AddVmessInbound(tag string, opt InboundOptions) error
 	RemoveInbound(tag string) error
+	// vless users live in a separate inbound
+	SetVlessUser(email string, uuid string) error
+	RemoveVlessUser(email string) error
+	// link named after proxy id, which does not reveal the secret
+	VlessLink(id uint, vlessid string) string
+	NewVlessProxy() Proxy
+	AddVlessInbound(tag string, opt InboundOptions) error
+	// trojan users are identified by password instead of uuid
+	SetTrojanUser(email string, password string) error
+	RemoveTrojanUser(email string) error
+	TrojanLink(id uint, password string) string
+	NewTrojanProxy() Proxy
+	AddTrojanInbound(tag string, opt InboundOptions) error
+	// each shadowsocks proxy owns a dedicated inbound
+	AddShadowsocksInbound(tag string, port uint16, email, cipher, password string) error
+	ShadowsocksLink(id uint, port uint16, cipher, password string) string
+	NewShadowsocksProxy() (Proxy, error)
 }
 
 // implemented by simpleTelegramAuthService
 type TelegramAuthService interface {
-	// 生成一个注册用的 token
-	GenToken() (token string)
+	// 生成一个注册用的 token，附带 deep link
+	GenToken(opt TokenOptions) (RegisterToken, error)
 	// 使用 token 注册用户，注册失败（token不匹配）返回错误
 	Register(token string, tid int) (User, error)
+	// tokens which are not expired, used up or revoked
+	Tokens() ([]RegisterToken, error)
+	RevokeToken(token string) error
+}
+
+// registration by requests approved by admins, implemented by
+// approvalTelegramAuthService. Check AuthServiceInstance for it
+type RegistrationApprover interface {
+	// 提交注册申请，每个用户同时只能有一个待处理的申请
+	SubmitRequest(req RegisterRequest) (RegisterRequest, error)
+	PendingRequests() ([]RegisterRequest, error)
+	// 注册用户并分配代理
+	Approve(id uint, admin int) (User, RegisterRequest, error)
+	Reject(id uint, admin int) (RegisterRequest, error)
 }
 
-// need implementation
+// implemented by systemdService and processService. Failed commands
+// are reported as *CommandError
 type SystemCtlService interface {
 	StartV2rayServer() error
 	StopV2rayServer() error
 	RestartV2rayServer() error
+	// human readable status of v2ray server
+	V2rayServerStatus() (string, error)
 }
 
 // describe a proxy config. Proxy can be store in sqldb
 type Proxy interface {
-	// identify this proxy
+	// name of registered ProxyType
+	ProxyType() string
+	// identify this proxy among proxies of the same type
 	ProxyID() uint
 	// apply this proxy
 	Activate() error
@@ -68,4 +136,6 @@ type Proxy interface {
 	Deactivate() error
 	// introduce this proxy in telegram message
 	Message() string
+	// share link imported by client apps, e.g. vmess://...
+	Link() string
 }
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"html"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/Project-Nessie/nessielight"
 	"github.com/Project-Nessie/nessielight/tgolf"
@@ -11,22 +14,15 @@ import (
 	"github.com/yanzay/tbot/v2"
 )
 
-// provide admin using cli
-func isAdmin(userid int) bool {
-	id := fmt.Sprint(userid)
-	for _, v := range admins {
-		if id == v {
-			return true
-		}
-	}
-	return false
-}
-
 var adminHelpText = `
 `
 
 var userManHelp = `
-Add User: generate new token for registering
+Add User: generate new token for registering, used once
+Custom Token: generate token with max uses, validity and quota of registered users
+Pending Requests: resend cards of registration requests waiting for approval (-auth approval)
+Set User: edit name, group, quota, expiry, notes and proxies of a user
+Set Quota: limit traffic of a user, e.g. <code>total=100GB</code>, <code>up=10GB,down=100GB</code> or <code>0</code> for unlimited
 `
 
 func registerAdminService(server *tgolf.Server) {
@@ -34,43 +30,63 @@ func registerAdminService(server *tgolf.Server) {
 		{{Text: "User Management", CallbackData: "a/user"}},
 		{{Text: "Service Control", CallbackData: "a/service"}},
 		{{Text: "Statistics", CallbackData: "a/statistics"}},
+		{{Text: "Broadcast", CallbackData: "a/broadcast"}},
+		{{Text: "Roles", CallbackData: "a/role"}},
 	}
 	userManBtns := [][]tbot.InlineKeyboardButton{
 		{{Text: "Add User", CallbackData: "a/user/add"}, {Text: "Delete User", CallbackData: "a/user/delete"}},
-		{{Text: "Set User", CallbackData: "a/user/set"}, {Text: "Go Back", CallbackData: "a/back"}},
+		{{Text: "Set User", CallbackData: "a/user/set"}, {Text: "Set Quota", CallbackData: "a/user/quota"}},
+		{{Text: "Custom Token", CallbackData: "a/user/token"}, {Text: "List Tokens", CallbackData: "a/user/tokens"}},
+	}
+	if _, ok := nessielight.AuthServiceInstance.(nessielight.RegistrationApprover); ok {
+		userManBtns = append(userManBtns, []tbot.InlineKeyboardButton{{Text: "Pending Requests", CallbackData: "a/user/requests"}})
 	}
+	userManBtns = append(userManBtns, []tbot.InlineKeyboardButton{{Text: "Go Back", CallbackData: "a/back"}})
 	serviceBtns := [][]tbot.InlineKeyboardButton{
-		{{Text: "Restart V2ray", CallbackData: "a/service/v2rayrestart"}},
-		{{Text: "View V2ray Log", CallbackData: "a/service/v2raylog"}},
+		{{Text: "Start V2ray", CallbackData: "a/service/v2raystart"}, {Text: "Stop V2ray", CallbackData: "a/service/v2raystop"}},
+		{{Text: "Restart V2ray", CallbackData: "a/service/v2rayrestart"}, {Text: "V2ray Status", CallbackData: "a/service/v2raystatus"}},
+		{{Text: "View V2ray Log", CallbackData: "a/service/v2raylog"}, {Text: "Jobs", CallbackData: "a/service/jobs"}},
 		{{Text: "Go Back", CallbackData: "a/back"}},
 	}
 	statisBtns := [][]tbot.InlineKeyboardButton{
 		{{Text: "Get Top Traffic", CallbackData: "a/statistics/toptraffic"}},
+		{{Text: "Last 24h", CallbackData: "a/statistics/day"}, {Text: "This Month", CallbackData: "a/statistics/month"}},
 		{{Text: "Reset Traffic", CallbackData: "a/statistics/resettraffic"}},
 		{{Text: "Go Back", CallbackData: "a/back"}},
 	}
 
-	server.Register("/admin", "Admin Control", combineInit(withPrivate, withAdmin), nil,
+	server.Register("/admin", "Admin Control", combineInit(withPrivate, withPermission(nessielight.PermAdminPanel)), nil,
 		func(argv []tgolf.Argument, from *tbot.User, chatid string) {
 			server.SendfWithBtn(chatid, adminBtns, "Your User ID: %d\n%s", from.ID, adminHelpText)
 		})
 
-	server.RegisterInlineButton("a/back", func(cq *tbot.CallbackQuery) error {
+	server.RegisterInlineButton("a/back", withPermission(nessielight.PermAdminPanel), func(cq *tbot.CallbackQuery) error {
 		server.EditCallbackMsgWithBtn(cq, adminBtns, "Your User ID: %d\n%s", cq.From.ID, adminHelpText)
 		return nil
 	})
-	server.RegisterInlineButton("a/user", func(cq *tbot.CallbackQuery) error {
+	server.RegisterInlineButton("a/user", withPermission(nessielight.PermAdminPanel), func(cq *tbot.CallbackQuery) error {
 		server.EditCallbackMsgWithBtn(cq, userManBtns, "User Management\n%s", userManHelp)
 		return nil
 	})
 	// 生成一个 token，用于注册用户
-	server.RegisterInlineButton("a/user/add", func(cq *tbot.CallbackQuery) error {
-		token := nessielight.AuthServiceInstance.GenToken()
-		server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{}, "token: <code>%s</code>", token)
+	server.RegisterInlineButton("a/user/add", withPermission(nessielight.PermUserAdd), func(cq *tbot.CallbackQuery) error {
+		opt := nessielight.TokenOptions{Creator: cq.From.ID, MaxUses: 1}
+		if tokenExpiry > 0 {
+			opt.ExpiresAt = time.Now().Add(tokenExpiry)
+		}
+		token, err := nessielight.AuthServiceInstance.GenToken(opt)
+		if err != nil {
+			return err
+		}
+		server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{}, "token: <code>%s</code>%s\nexpires: <b>%s</b>",
+			token.Token, tokenLinkText(token), expiryText(opt.ExpiresAt))
 		return nil
 	})
+	registerTokenService(server)
+	registerRoleService(server)
+	registerBroadcastService(server)
 
-	server.Register(">>>user/delete", "", nil, []tgolf.Parameter{
+	server.Register(">>>user/delete", "", withPermission(nessielight.PermUserDelete), []tgolf.Parameter{
 		tgolf.NewParam("id", "user id", func(value string) bool {
 			id, err := strconv.ParseInt(value, 10, 32)
 			if err != nil {
@@ -97,50 +113,105 @@ func registerAdminService(server *tgolf.Server) {
 		server.Sendf(chatid, "done.")
 	})
 
-	server.RegisterInlineButton("a/user/delete", func(cq *tbot.CallbackQuery) error {
+	server.RegisterInlineButton("a/user/delete", withPermission(nessielight.PermUserDelete), func(cq *tbot.CallbackQuery) error {
 		users, err := nessielight.UserManagerInstance.All()
 		if err != nil {
 			return err
 		}
 		msg := "Users:\n"
 		for _, v := range users {
-			msg += fmt.Sprint(v.Name(), ": <code>", v.TelegramID(), "</code>\n")
+			msg += fmt.Sprint(html.EscapeString(v.Name()), ": <code>", v.TelegramID(), "</code>\n")
 		}
 		server.EditCallbackBtn(cq, [][]tbot.InlineKeyboardButton{})
-		server.Sendf(cq.Message.Chat.ID, msg)
+		server.Sendf(cq.Message.Chat.ID, "%s", msg)
 		if err := server.StartCommand(">>>user/delete", cq.From, cq.Message.Chat); err != nil {
 			return err
 		}
 		return nil
 	})
-	// !!!UNIMPLEMENTED
-	server.RegisterInlineButton("a/user/set", func(cq *tbot.CallbackQuery) error {
-		server.EditCallbackMsg(cq, "<i>set user not implemented</i>")
-		return nil
+	server.Register(">>>user/quota", "", withPermission(nessielight.PermUserEdit), []tgolf.Parameter{
+		tgolf.NewParam("id", "user id", func(value string) bool {
+			id, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return false
+			}
+			user, err := GetUserByTid(int(id))
+			return err == nil && user != nil
+		}),
+		tgolf.NewParam("quota", "quota, e.g. <code>total=100GB</code>", func(value string) bool {
+			_, err := nessielight.ParseTrafficQuota(value)
+			return err == nil
+		}),
+	}, func(argv []tgolf.Argument, from *tbot.User, chatid string) {
+		id, _ := strconv.ParseInt(argv[0].Value, 10, 32)
+		quota, _ := nessielight.ParseTrafficQuota(argv[1].Value)
+		user, err := GetUserByTid(int(id))
+		if err != nil || user == nil {
+			server.Sendf(chatid, "user not found")
+			return
+		}
+		if err := user.SetQuota(quota); err != nil {
+			server.Sendf(chatid, "set quota failed: %s", err.Error())
+			return
+		}
+		if err := nessielight.UserManagerInstance.SetUser(user); err != nil {
+			server.Sendf(chatid, "set quota failed: %s", err.Error())
+			return
+		}
+		if err := nessielight.EnforceQuota(user); err != nil {
+			server.Sendf(chatid, "enforce quota failed: %s", err.Error())
+			return
+		}
+		traffic := user.Traffic()
+		server.Sendf(chatid, "done. quota <b>%v</b>, used down <b>%v</b> up <b>%v</b>, suspended: <b>%v</b>",
+			quota, traffic.Downlink, traffic.Uplink, user.Suspension() != "")
+	})
+	server.RegisterInlineButton("a/user/quota", withPermission(nessielight.PermUserEdit), func(cq *tbot.CallbackQuery) error {
+		users, err := nessielight.UserManagerInstance.All()
+		if err != nil {
+			return err
+		}
+		msg := "Users:\n"
+		for _, v := range users {
+			msg += fmt.Sprint(html.EscapeString(v.Name()), ": <code>", v.TelegramID(), "</code> quota ", v.Quota(), "\n")
+		}
+		server.EditCallbackBtn(cq, [][]tbot.InlineKeyboardButton{})
+		server.Sendf(cq.Message.Chat.ID, "%s", msg)
+		return server.StartCommand(">>>user/quota", cq.From, cq.Message.Chat)
 	})
 
-	server.RegisterInlineButton("a/service", func(cq *tbot.CallbackQuery) error {
+	registerUserEditor(server)
+
+	server.RegisterInlineButton("a/service", withPermission(nessielight.PermAdminPanel), func(cq *tbot.CallbackQuery) error {
 		server.EditCallbackMsgWithBtn(cq, serviceBtns, "Service Control")
 		return nil
 	})
 
-	// !!!UNIMPLEMENTED
-	server.RegisterInlineButton("a/service/v2rayrestart", func(cq *tbot.CallbackQuery) error {
-		server.EditCallbackMsg(cq, "<i>v2ray start not implemented</i>")
-		return nil
+	server.RegisterInlineButton("a/service/v2raystart", withPermission(nessielight.PermServiceRestart), func(cq *tbot.CallbackQuery) error {
+		return v2rayControl(server, cq, "start", func(s nessielight.SystemCtlService) error {
+			return s.StartV2rayServer()
+		})
 	})
-	// !!!UNIMPLEMENTED
-	server.RegisterInlineButton("a/service/v2raylog", func(cq *tbot.CallbackQuery) error {
-		server.EditCallbackMsg(cq, "<i>v2ray log not implemented</i>")
-		return nil
+	server.RegisterInlineButton("a/service/v2raystop", withPermission(nessielight.PermServiceRestart), func(cq *tbot.CallbackQuery) error {
+		return v2rayControl(server, cq, "stop", func(s nessielight.SystemCtlService) error {
+			return s.StopV2rayServer()
+		})
+	})
+	server.RegisterInlineButton("a/service/v2rayrestart", withPermission(nessielight.PermServiceRestart), func(cq *tbot.CallbackQuery) error {
+		return v2rayControl(server, cq, "restart", func(s nessielight.SystemCtlService) error {
+			return s.RestartV2rayServer()
+		})
+	})
+	server.RegisterInlineButton("a/service/v2raystatus", withPermission(nessielight.PermServiceStatus), func(cq *tbot.CallbackQuery) error {
+		return v2rayControl(server, cq, "status", nil)
 	})
 
-	server.RegisterInlineButton("a/statistics", func(cq *tbot.CallbackQuery) error {
+	server.RegisterInlineButton("a/statistics", withPermission(nessielight.PermAdminPanel), func(cq *tbot.CallbackQuery) error {
 		server.EditCallbackMsgWithBtn(cq, statisBtns, "Service Control")
 		return nil
 	})
 
-	server.RegisterInlineButton("a/statistics/toptraffic", func(cq *tbot.CallbackQuery) error {
+	server.RegisterInlineButton("a/statistics/toptraffic", withPermission(nessielight.PermTrafficView), func(cq *tbot.CallbackQuery) error {
 		inbounds, err := nessielight.GetV2rayTraffic()
 		if err != nil {
 			return err
@@ -177,9 +248,103 @@ func registerAdminService(server *tgolf.Server) {
 		server.EditCallbackMsg(cq, msg)
 		return nil
 	})
-	// !!!UNIMPLEMENTED
-	server.RegisterInlineButton("a/statistics/resettraffic", func(cq *tbot.CallbackQuery) error {
-		server.EditCallbackMsg(cq, "<i>reset traffic not implemented</i>")
+	server.RegisterInlineButton("a/statistics/day", withPermission(nessielight.PermTrafficView), func(cq *tbot.CallbackQuery) error {
+		now := time.Now()
+		return showTrafficHistory(server, cq, "last 24h", now.Add(-24*time.Hour), now)
+	})
+	server.RegisterInlineButton("a/statistics/month", withPermission(nessielight.PermTrafficView), func(cq *tbot.CallbackQuery) error {
+		now := time.Now()
+		return showTrafficHistory(server, cq, "this month", monthStart(now), now)
+	})
+}
+
+// run a v2ray control action, then report its result along with v2ray status.
+// users are re-applied after v2ray (re)starts
+func v2rayControl(server *tgolf.Server, cq *tbot.CallbackQuery, name string,
+	action func(nessielight.SystemCtlService) error) error {
+	service := nessielight.SystemCtlServiceInstance
+	if service == nil {
+		server.EditCallbackMsg(cq, "<i>v2ray is not controlled by nessielight, see -v2rayctl</i>")
 		return nil
+	}
+	msg := ""
+	if action != nil {
+		server.EditCallbackMsg(cq, "<i>%s v2ray...</i>", name)
+		// stats of v2ray are lost when it stops
+		if name != "start" {
+			if err := nessielight.V2rayUpdateUserTraffic(); err != nil {
+				msg += fmt.Sprintf("collect traffic failed: %s\n", html.EscapeString(err.Error()))
+			}
+		}
+		if err := action(service); err != nil {
+			msg += fmt.Sprintf("<b>%s failed</b>: %s\n", name, html.EscapeString(err.Error()))
+			var cmdErr *nessielight.CommandError
+			if errors.As(err, &cmdErr) && cmdErr.Output != "" {
+				msg += fmt.Sprintf("<pre>%s</pre>\n", html.EscapeString(truncate(cmdErr.Output, 1500)))
+			}
+		} else {
+			msg += fmt.Sprintf("<b>%s succeed</b>\n", name)
+			if name != "stop" {
+				if err := nessielight.ReloadV2ray(); err != nil {
+					msg += fmt.Sprintf("restore users failed: %s\n", html.EscapeString(err.Error()))
+				} else {
+					msg += "users restored\n"
+				}
+			}
+		}
+	}
+	status, err := service.V2rayServerStatus()
+	if err != nil {
+		msg += fmt.Sprintf("<b>status</b>: %s\n", html.EscapeString(err.Error()))
+	}
+	msg += fmt.Sprintf("<pre>%s</pre>", html.EscapeString(truncate(status, 2000)))
+	server.EditCallbackMsg(cq, msg)
+	return nil
+}
+
+// show traffic history between since and until by inbound and by user, sorted by downlink
+func showTrafficHistory(server *tgolf.Server, cq *tbot.CallbackQuery, title string, since, until time.Time) error {
+	if err := nessielight.V2rayUpdateUserTraffic(); err != nil {
+		return err
+	}
+	msg, err := trafficHistoryText(title, since, until)
+	if err != nil {
+		return err
+	}
+	server.EditCallbackMsg(cq, msg)
+	return nil
+}
+
+func trafficHistoryText(title string, since, until time.Time) (string, error) {
+	byUser, byInbound, err := nessielight.GroupTrafficHistory(since, until)
+	if err != nil {
+		return "", err
+	}
+	inbounds := make([]nessielight.NamedTraffic, 0, len(byInbound))
+	for name, v := range byInbound {
+		inbounds = append(inbounds, nessielight.NamedTraffic{TrafficValue: v, Name: name})
+	}
+	sort.Slice(inbounds, func(i, j int) bool {
+		return inbounds[i].Downlink > inbounds[j].Downlink
+	})
+	users := make([]nessielight.NamedTraffic, 0, len(byUser))
+	for tid, v := range byUser {
+		name := fmt.Sprint(tid)
+		if user, err := GetUserByTid(tid); err == nil && user != nil {
+			name = user.Name()
+		}
+		users = append(users, nessielight.NamedTraffic{TrafficValue: v, Name: name})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Downlink > users[j].Downlink
 	})
+
+	format := func(msg string, v nessielight.NamedTraffic) string {
+		return fmt.Sprintf("%s%s down <b>%v</b> up <b>%v</b>\n", msg, v.Name, v.Downlink, v.Uplink)
+	}
+	msg := fmt.Sprintf("<b><u>Inbound Traffics of %s</u></b>\n", title)
+	msg = utils.Reduce(inbounds, format, msg)
+	msg = msg + fmt.Sprintf("\n<b><u>User Traffics of %s</u></b>\n", title)
+	msg = utils.Reduce(users, format, msg)
+	return msg, nil
 }
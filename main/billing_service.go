@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Project-Nessie/nessielight"
+	"github.com/Project-Nessie/nessielight/tgolf"
+	"github.com/yanzay/tbot/v2"
+)
+
+// number of finished cycles shown to users
+const cycleHistorySize = 6
+
+// user whose traffic an admin is going to reset, waiting for confirmation
+var pendingResets = struct {
+	sync.Mutex
+	m map[int]int
+}{m: make(map[int]int)}
+
+var resetHelp = `
+Reset One User: archive traffic of a user and start a new billing cycle
+Reset All Users: the same for every user
+Set Cycle Day: day of month when traffic of a user is reset, <code>0</code> to follow <code>-cycleday</code>
+`
+
+func registerBillingService(server *tgolf.Server) {
+	resetBtns := [][]tbot.InlineKeyboardButton{
+		{{Text: "Reset One User", CallbackData: "a/statistics/resetuser"}, {Text: "Reset All Users", CallbackData: "a/statistics/resetall"}},
+		{{Text: "Set Cycle Day", CallbackData: "a/statistics/cycleday"}},
+		{{Text: "Go Back", CallbackData: "a/statistics"}},
+	}
+
+	server.RegisterInlineButton("a/statistics/resettraffic", withPermission(nessielight.PermTrafficView), func(cq *tbot.CallbackQuery) error {
+		users, err := nessielight.UserManagerInstance.All()
+		if err != nil {
+			return err
+		}
+		defaultDay := "disabled"
+		if nessielight.BillingCycleDay > 0 {
+			defaultDay = strconv.Itoa(nessielight.BillingCycleDay)
+		}
+		msg := fmt.Sprintf("<b>Billing Cycles</b>\ndefault cycle day: <b>%s</b>\n\n", defaultDay)
+		for _, v := range users {
+			traffic := v.Traffic()
+			msg += fmt.Sprintf("%s: <code>%d</code> day <b>%s</b> since <b>%s</b> down <b>%v</b> up <b>%v</b>\n",
+				html.EscapeString(v.Name()), v.TelegramID(), cycleDayText(v.CycleDay()), cycleTimeText(v.CycleStart()),
+				traffic.Downlink, traffic.Uplink)
+		}
+		server.EditCallbackMsgWithBtn(cq, resetBtns, "%s%s", msg, resetHelp)
+		return nil
+	})
+
+	server.RegisterInlineButton("a/statistics/resetall", withPermission(nessielight.PermTrafficReset), func(cq *tbot.CallbackQuery) error {
+		server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{
+			{{Text: "Confirm", CallbackData: "a/statistics/resetall/confirm"}, {Text: "Cancel", CallbackData: "a/statistics/resettraffic"}},
+		}, "Reset traffic of <b>all users</b>? Current traffic is archived as a finished cycle.")
+		return nil
+	})
+	server.RegisterInlineButton("a/statistics/resetall/confirm", withPermission(nessielight.PermTrafficReset), func(cq *tbot.CallbackQuery) error {
+		if err := nessielight.V2rayUpdateUserTraffic(); err != nil {
+			return err
+		}
+		users, err := nessielight.UserManagerInstance.All()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		msg := ""
+		for _, v := range users {
+			if err := nessielight.ResetUserTraffic(v, now); err != nil {
+				msg += fmt.Sprintf("%s: %s\n", html.EscapeString(v.Name()), html.EscapeString(err.Error()))
+			}
+		}
+		server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{},
+			"reset traffic of %d users.\n%s", len(users), msg)
+		return nil
+	})
+
+	server.Register(">>>traffic/reset", "", withPermission(nessielight.PermTrafficReset), []tgolf.Parameter{
+		tgolf.NewParam("id", "user id", func(value string) bool {
+			id, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return false
+			}
+			user, err := GetUserByTid(int(id))
+			return err == nil && user != nil
+		}),
+	}, func(argv []tgolf.Argument, from *tbot.User, chatid string) {
+		id, _ := strconv.ParseInt(argv[0].Value, 10, 32)
+		user, err := GetUserByTid(int(id))
+		if err != nil || user == nil {
+			server.Sendf(chatid, "user not found")
+			return
+		}
+		pendingResets.Lock()
+		pendingResets.m[from.ID] = user.TelegramID()
+		pendingResets.Unlock()
+		traffic := user.Traffic()
+		server.SendfWithBtn(chatid, [][]tbot.InlineKeyboardButton{
+			{{Text: "Confirm", CallbackData: "a/statistics/resetuser/confirm"}, {Text: "Cancel", CallbackData: "a/statistics/resettraffic"}},
+		}, "Reset traffic of <b>%s</b>? down <b>%v</b> up <b>%v</b> since <b>%s</b> will be archived.",
+			html.EscapeString(user.Name()), traffic.Downlink, traffic.Uplink, cycleTimeText(user.CycleStart()))
+	})
+	server.RegisterInlineButton("a/statistics/resetuser", withPermission(nessielight.PermTrafficReset), func(cq *tbot.CallbackQuery) error {
+		server.EditCallbackBtn(cq, [][]tbot.InlineKeyboardButton{})
+		return server.StartCommand(">>>traffic/reset", cq.From, cq.Message.Chat)
+	})
+	server.RegisterInlineButton("a/statistics/resetuser/confirm", withPermission(nessielight.PermTrafficReset), func(cq *tbot.CallbackQuery) error {
+		pendingResets.Lock()
+		tid, ok := pendingResets.m[cq.From.ID]
+		delete(pendingResets.m, cq.From.ID)
+		pendingResets.Unlock()
+		if !ok {
+			server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{}, "<i>nothing to reset</i>")
+			return nil
+		}
+		if err := nessielight.V2rayUpdateUserTraffic(); err != nil {
+			return err
+		}
+		user, err := GetUserByTid(tid)
+		if err != nil || user == nil {
+			server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{}, "user not found")
+			return nil
+		}
+		if err := nessielight.ResetUserTraffic(user, time.Now()); err != nil {
+			return err
+		}
+		server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{},
+			"done. traffic of <b>%s</b> is reset.", html.EscapeString(user.Name()))
+		return nil
+	})
+
+	server.Register(">>>user/cycleday", "", withPermission(nessielight.PermUserEdit), []tgolf.Parameter{
+		tgolf.NewParam("id", "user id", func(value string) bool {
+			id, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return false
+			}
+			user, err := GetUserByTid(int(id))
+			return err == nil && user != nil
+		}),
+		tgolf.NewParam("day", "day of month (1-31), 0 for default", func(value string) bool {
+			day, err := strconv.Atoi(value)
+			return err == nil && day >= 0 && day <= 31
+		}),
+	}, func(argv []tgolf.Argument, from *tbot.User, chatid string) {
+		id, _ := strconv.ParseInt(argv[0].Value, 10, 32)
+		day, _ := strconv.Atoi(argv[1].Value)
+		user, err := GetUserByTid(int(id))
+		if err != nil || user == nil {
+			server.Sendf(chatid, "user not found")
+			return
+		}
+		if err := user.SetCycleDay(day); err != nil {
+			server.Sendf(chatid, "set cycle day failed: %s", err.Error())
+			return
+		}
+		if err := nessielight.UserManagerInstance.SetUser(user); err != nil {
+			server.Sendf(chatid, "set cycle day failed: %s", err.Error())
+			return
+		}
+		server.Sendf(chatid, "done. cycle day of <b>%s</b> is <b>%s</b>", html.EscapeString(user.Name()), cycleDayText(day))
+	})
+	server.RegisterInlineButton("a/statistics/cycleday", withPermission(nessielight.PermUserEdit), func(cq *tbot.CallbackQuery) error {
+		server.EditCallbackBtn(cq, [][]tbot.InlineKeyboardButton{})
+		return server.StartCommand(">>>user/cycleday", cq.From, cq.Message.Chat)
+	})
+
+	server.RegisterInlineButton("p/cycles", withAuth, func(cq *tbot.CallbackQuery) error {
+		if err := nessielight.V2rayUpdateUserTraffic(); err != nil {
+			return err
+		}
+		user, err := GetUserByTid(cq.From.ID)
+		if err != nil {
+			return err
+		}
+		cycles, err := nessielight.UserCycles(user.TelegramID(), cycleHistorySize)
+		if err != nil {
+			return err
+		}
+		traffic := user.Traffic()
+		msg := fmt.Sprintf("<b>Billing Cycles</b>\ncurrent: since <b>%s</b> down <b>%v</b> up <b>%v</b>\n",
+			cycleTimeText(user.CycleStart()), traffic.Downlink, traffic.Uplink)
+		for _, v := range cycles {
+			msg += fmt.Sprintf("%s - %s: down <b>%v</b> up <b>%v</b>\n",
+				cycleTimeText(v.Start), cycleTimeText(v.End), v.Downlink, v.Uplink)
+		}
+		if len(cycles) == 0 {
+			msg += "<i>no finished cycles</i>\n"
+		}
+		server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{
+			{{Text: "Go Back", CallbackData: "p/back"}},
+		}, msg)
+		return nil
+	})
+}
+
+func cycleDayText(day int) string {
+	if day <= 0 {
+		return "default"
+	}
+	return strconv.Itoa(day)
+}
+
+func cycleTimeText(t time.Time) string {
+	if t.IsZero() {
+		return "registration"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Project-Nessie/nessielight"
+	"github.com/Project-Nessie/nessielight/tgolf"
+	"github.com/yanzay/tbot/v2"
+)
+
+// interval of editing the status message while broadcasting
+const broadcastProgressInterval = 2 * time.Second
+
+// max failed recipients listed in the report of a broadcast
+const broadcastReportSize = 30
+
+// message composed by an admin, waiting for confirmation
+type broadcastDraft struct {
+	id int
+	// all, active, overquota or group
+	audience string
+	group    string
+	// html text, empty if a message is copied
+	text string
+	// chat and id of the copied message
+	fromChat  string
+	messageID int
+}
+
+// recipients of the draft
+func (r *broadcastDraft) recipients() ([]nessielight.User, error) {
+	users, err := nessielight.UserManagerInstance.All()
+	if err != nil {
+		return nil, err
+	}
+	var res []nessielight.User
+	for _, v := range users {
+		switch r.audience {
+		case "active":
+			if v.Suspension() != "" {
+				continue
+			}
+		case "overquota":
+			if !v.Quota().Exceeded(v.Traffic()) {
+				continue
+			}
+		case "group":
+			if v.Group() != r.group {
+				continue
+			}
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+func (r *broadcastDraft) audienceText() string {
+	switch r.audience {
+	case "active":
+		return "active users"
+	case "overquota":
+		return "users over quota"
+	case "group":
+		return "users in group <b>" + html.EscapeString(r.group) + "</b>"
+	}
+	return "all users"
+}
+
+// drafts of admins, and the id of the last draft
+var broadcasts = struct {
+	sync.Mutex
+	m    map[int]*broadcastDraft
+	last int
+}{m: make(map[int]*broadcastDraft)}
+
+func registerBroadcastService(server *tgolf.Server) {
+	audienceBtns := [][]tbot.InlineKeyboardButton{
+		{{Text: "All Users", CallbackData: "a/broadcast/to/all"}, {Text: "Active Users", CallbackData: "a/broadcast/to/active"}},
+		{{Text: "Over Quota", CallbackData: "a/broadcast/to/overquota"}, {Text: "By Group", CallbackData: "a/broadcast/to/group"}},
+		{{Text: "Go Back", CallbackData: "a/back"}},
+	}
+	server.RegisterInlineButton("a/broadcast", withPermission(nessielight.PermBroadcast), func(cq *tbot.CallbackQuery) error {
+		server.EditCallbackMsgWithBtn(cq, audienceBtns, "<b>Broadcast</b>\nsend a message to users, pick recipients first")
+		return nil
+	})
+
+	// start a draft and ask for the message
+	compose := func(from *tbot.User, chat tbot.Chat, audience, group string) error {
+		broadcasts.Lock()
+		broadcasts.last++
+		broadcasts.m[from.ID] = &broadcastDraft{id: broadcasts.last, audience: audience, group: group}
+		broadcasts.Unlock()
+		return server.StartCommand(">>>broadcast/compose", from, chat)
+	}
+	for _, audience := range []string{"all", "active", "overquota"} {
+		audience := audience
+		server.RegisterInlineButton("a/broadcast/to/"+audience, withPermission(nessielight.PermBroadcast), func(cq *tbot.CallbackQuery) error {
+			server.EditCallbackBtn(cq, [][]tbot.InlineKeyboardButton{})
+			return compose(cq.From, cq.Message.Chat, audience, "")
+		})
+	}
+	server.Register(">>>broadcast/group", "", withPermission(nessielight.PermBroadcast), []tgolf.Parameter{
+		tgolf.NewParam("group", "group of recipients", nil),
+	}, func(argv []tgolf.Argument, from *tbot.User, chatid string) {
+		if err := compose(from, argv[0].Message.Chat, "group", argv[0].Value); err != nil {
+			server.Sendf(chatid, "%s", html.EscapeString(err.Error()))
+		}
+	})
+	server.RegisterInlineButton("a/broadcast/to/group", withPermission(nessielight.PermBroadcast), func(cq *tbot.CallbackQuery) error {
+		server.EditCallbackBtn(cq, [][]tbot.InlineKeyboardButton{})
+		return server.StartCommand(">>>broadcast/group", cq.From, cq.Message.Chat)
+	})
+
+	// preview the message and ask for confirmation
+	server.Register(">>>broadcast/compose", "", withPermission(nessielight.PermBroadcast), []tgolf.Parameter{
+		tgolf.NewParam("message", "message in HTML, or forward a message to send it as is", nil),
+	}, func(argv []tgolf.Argument, from *tbot.User, chatid string) {
+		m := argv[0].Message
+		broadcasts.Lock()
+		draft := broadcasts.m[from.ID]
+		if draft != nil {
+			// messages without text, such as photos, are copied too
+			if m.ForwardDate != 0 || m.Text == "" {
+				draft.fromChat, draft.messageID = m.Chat.ID, m.MessageID
+			} else {
+				draft.text = m.Text
+			}
+		}
+		broadcasts.Unlock()
+		if draft == nil {
+			server.Sendf(chatid, "no broadcast is being composed")
+			return
+		}
+		recipients, err := draft.recipients()
+		if err != nil {
+			server.Sendf(chatid, "%s", html.EscapeString(err.Error()))
+			return
+		}
+		server.Sendf(chatid, "<b>Preview</b>")
+		if err := draft.send(server, chatid); err != nil {
+			server.Sendf(chatid, "preview failed: %s", html.EscapeString(err.Error()))
+			return
+		}
+		server.SendfWithBtn(chatid, [][]tbot.InlineKeyboardButton{{
+			{Text: fmt.Sprintf("Send to %d Users", len(recipients)), CallbackData: fmt.Sprintf("a/broadcast/send/%d", draft.id)},
+			{Text: "Cancel", CallbackData: "a/broadcast/cancel"},
+		}}, "Send the message above to %s (%d)?", draft.audienceText(), len(recipients))
+	})
+
+	server.RegisterInlineButton("a/broadcast/cancel", withPermission(nessielight.PermBroadcast), func(cq *tbot.CallbackQuery) error {
+		broadcasts.Lock()
+		delete(broadcasts.m, cq.From.ID)
+		broadcasts.Unlock()
+		server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{}, "Broadcast canceled.")
+		return nil
+	})
+
+	server.RegisterInlineButtonPrefix("a/broadcast/send/", withPermission(nessielight.PermBroadcast), func(cq *tbot.CallbackQuery) error {
+		id, err := strconv.Atoi(strings.TrimPrefix(cq.Data, "a/broadcast/send/"))
+		if err != nil {
+			return fmt.Errorf("invalid broadcast %s", cq.Data)
+		}
+		// take the draft, so it is sent only once
+		broadcasts.Lock()
+		draft := broadcasts.m[cq.From.ID]
+		if draft != nil && draft.id == id {
+			delete(broadcasts.m, cq.From.ID)
+		} else {
+			draft = nil
+		}
+		broadcasts.Unlock()
+		if draft == nil {
+			server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{}, "This broadcast has been sent or replaced.")
+			return nil
+		}
+		recipients, err := draft.recipients()
+		if err != nil {
+			return err
+		}
+		logger.Printf("admin %d broadcasts to %s, %d users", cq.From.ID, draft.audience, len(recipients))
+		go broadcast(server, cq, draft, recipients)
+		return nil
+	})
+}
+
+// send the draft to chatid
+func (r *broadcastDraft) send(server *tgolf.Server, chatid string) error {
+	if r.text == "" {
+		// copied, so recipients do not see who forwarded it
+		return server.CopyMessage(chatid, r.fromChat, r.messageID)
+	}
+	_, err := server.Sendf(chatid, "%s", r.text)
+	return err
+}
+
+// send the draft to recipients through the notifier, editing the status
+// message of cq with progress and finally a report of failed recipients
+func broadcast(server *tgolf.Server, cq *tbot.CallbackQuery, draft *broadcastDraft, recipients []nessielight.User) {
+	var mu sync.Mutex
+	sent := 0
+	var failed []string
+	finished := make(chan struct{})
+	if len(recipients) == 0 {
+		close(finished)
+	}
+	// queueing blocks when the queue of the notifier is full
+	go func() {
+		for _, user := range recipients {
+			user := user
+			chatid := strconv.Itoa(user.TelegramID())
+			nessielight.NotifierInstance.SendFunc(user.TelegramID(), func() error {
+				return sendError(draft.send(server, chatid))
+			}, func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if err == nil {
+					sent++
+				} else {
+					failed = append(failed, fmt.Sprintf("<code>%d</code> %s: %s", user.TelegramID(),
+						html.EscapeString(user.Name()), html.EscapeString(err.Error())))
+				}
+				if sent+len(failed) == len(recipients) {
+					close(finished)
+				}
+			})
+		}
+	}()
+
+	progress := func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return sent, len(failed)
+	}
+	server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{},
+		"<b>Broadcasting</b> to %s\nsent 0, failed 0 of %d", draft.audienceText(), len(recipients))
+	ticker := time.NewTicker(broadcastProgressInterval)
+	defer ticker.Stop()
+	lastSent, lastFailed := 0, 0
+	for done := false; !done; {
+		select {
+		case <-finished:
+			done = true
+		case <-ticker.C:
+			s, f := progress()
+			if s == lastSent && f == lastFailed {
+				continue
+			}
+			lastSent, lastFailed = s, f
+			server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{},
+				"<b>Broadcasting</b> to %s\nsent %d, failed %d of %d", draft.audienceText(), s, f, len(recipients))
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	msg := fmt.Sprintf("<b>Broadcast finished</b> to %s\nsent %d, failed %d of %d", draft.audienceText(),
+		sent, len(failed), len(recipients))
+	for i, v := range failed {
+		if i == broadcastReportSize {
+			msg += fmt.Sprintf("\nand %d more", len(failed)-i)
+			break
+		}
+		msg += "\n" + v
+	}
+	server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{}, "%s", msg)
+	logger.Printf("broadcast by admin %d finished, sent %d, failed %d", cq.From.ID, sent, len(failed))
+}
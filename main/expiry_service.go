@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Project-Nessie/nessielight"
+	"github.com/Project-Nessie/nessielight/tgolf"
+)
+
+// suspend expired users and remind users expiring within -expiryremind days
+func checkExpiry(server *tgolf.Server, now time.Time) error {
+	if err := nessielight.CheckExpiry(now); err != nil {
+		return err
+	}
+	if expiryRemind <= 0 {
+		return nil
+	}
+	users, err := nessielight.DueExpiryReminders(now, time.Duration(expiryRemind)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		nessielight.Notify(user, nessielight.EventExpirySoon, nessielight.NotifyData{Remaining: remainingText(user, now)})
+		if err := nessielight.SetExpiryReminded(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remaining time of a user account
+func remainingText(user nessielight.User, now time.Time) string {
+	expiry := user.Expiry()
+	switch {
+	case expiry.IsZero():
+		return "never"
+	case nessielight.Expired(user, now):
+		return "expired at " + expiryText(expiry)
+	}
+	return fmt.Sprintf("in %s (%s)", durationText(expiry.Sub(now)), expiryText(expiry))
+}
+
+// duration in days and hours, or minutes if shorter than an hour
+func durationText(d time.Duration) string {
+	days := int(d / (24 * time.Hour))
+	hours := int(d % (24 * time.Hour) / time.Hour)
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh", hours)
+	}
+	return fmt.Sprintf("%dm", int(d/time.Minute))
+}
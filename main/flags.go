@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"time"
 )
 
 type arrayFlags []string
@@ -25,10 +26,69 @@ var webhookUrl string
 // telegram bot server listening address
 var listenAddr string
 
+// subscription server listening address, empty to disable subscription
+var subListen string
+
+// public url of subscription server, which is prefix of subscription urls
+var subUrl string
+
+// HMAC key of inline button callback data, empty to leave callback data unsigned
+var callbackSecret string
+
+// file of clash rules, one rule per line
+var clashRules string
+
 // v2ray api server listening address https://guide.v2fly.org/en_US/advanced/traffic.html#configuration-example
 var v2rayApi string
 
-// telegram user ID of admins
+// how v2ray is controlled: none, systemd or process
+var v2rayCtl string
+
+// systemd unit of v2ray
+var v2rayUnit string
+
+// v2ray executable and config, used when v2ray runs as child process
+var v2rayBin, v2rayConfig string
+
+// v2ray log files, shown in admin panel
+var v2rayAccessLog, v2rayErrorLog string
+
+// schedules of background jobs, an interval like "5m" or a cron expression
+// like "0 9 * * *". see nessielight.ParseSchedule
+var trafficSchedule, quotaSchedule, expirySchedule string
+
+// schedule of traffic reports sent to admins, empty to disable
+var reportSchedule string
+
+// how users register: token, or approval which also accepts /request approved by admins
+var authMode string
+
+// quota of users registered by approved requests, see nessielight.ParseTrafficQuota
+var approvalQuota string
+
+// validity and group of users registered by approved requests
+var approvalValidity time.Duration
+var approvalGroup string
+
+// days before expiry when users are reminded, 0 to disable
+var expiryRemind int
+
+// min interval between notifications, which keeps the bot under telegram rate limits
+var notifyInterval time.Duration
+
+// retries of a failed notification
+var notifyRetries int
+
+// validity of tokens generated by Add User
+var tokenExpiry time.Duration
+
+// day of month when billing cycles start, 0 to disable automatic traffic reset
+var cycleDay int
+
+// retention of traffic history, see nessielight.TrafficHistoryConfig
+var historyRaw, historyStep, historyRetention time.Duration
+
+// telegram user ID of owners granted on first start, see nessielight.BootstrapOwners
 var admins arrayFlags
 
 // tag of preconfigured inbound for user proxy
@@ -46,15 +106,93 @@ var vmessPort int
 // vmess port connected by client (usually 443)
 var vmessClientPort int
 
+// inbound options of vmess, vless and trojan, e.g. "network=grpc&serviceName=nessie".
+// see nessielight.ParseInboundOptions
+var vmessTransport, vlessTransport, trojanTransport string
+
+// tag of vless inbound, vless is disabled if empty
+var vlessTag string
+
+// vless listening port
+var vlessPort int
+
+// vless websocket path
+var vlessWsPath string
+
+// tag of trojan inbound, trojan is disabled if empty
+var trojanTag string
+
+// trojan listening port
+var trojanPort int
+
+// trojan websocket path
+var trojanWsPath string
+
+// prefix of shadowsocks inbound tags, shadowsocks is disabled if empty
+var ssTag string
+
+// shadowsocks listening address
+var ssListen string
+
+// shadowsocks port range, one port per proxy
+var ssPortMin, ssPortMax int
+
+// shadowsocks AEAD cipher of new proxies
+var ssCipher string
+
+// SIP003 plugin string appended to ss links
+var ssPlugin string
+
 func init() {
 	flag.StringVar(&botToken, "token", "", "tg bot token")
 	flag.StringVar(&webhookUrl, "webhook", "", "tg bot webhook url")
 	flag.StringVar(&listenAddr, "listen", "127.0.0.1:3456", "listen address")
-	flag.Var(&admins, "admin", "init admin using tg user id")
+	flag.Var(&admins, "admin", "grant owner role to tg user id if there is no owner yet")
+	flag.StringVar(&callbackSecret, "callbacksecret", "", "sign inline button data with this HMAC key, so it cannot be forged (empty to disable)")
+	flag.IntVar(&cycleDay, "cycleday", 0, "day of month when traffic is reset (0 to disable)")
+	flag.StringVar(&trafficSchedule, "trafficschedule", "5m", "schedule of collecting traffic, an interval or a cron expression")
+	flag.StringVar(&quotaSchedule, "quotaschedule", "5m", "schedule of billing cycle and quota checks, an interval or a cron expression")
+	flag.StringVar(&expirySchedule, "expiryschedule", "10m", "schedule of expiry checks and reminders, an interval or a cron expression")
+	flag.StringVar(&reportSchedule, "reportschedule", "", "schedule of traffic reports sent to admins, e.g. \"0 9 * * *\" (empty to disable)")
+	flag.StringVar(&clashRules, "clashrules", "", "file of rules in clash profiles, one rule per line (default LAN and CN direct)")
+	flag.StringVar(&subListen, "sublisten", "", "subscription server listening address (empty to disable subscription)")
+	flag.StringVar(&subUrl, "suburl", "", "public url of subscription server, e.g. https://example.com/")
+	flag.DurationVar(&historyRaw, "historyraw", 48*time.Hour, "keep collected traffic deltas for this long before downsampling")
+	flag.DurationVar(&historyStep, "historystep", time.Hour, "downsampling step of traffic history")
+	flag.DurationVar(&historyRetention, "historyretention", 0, "keep traffic history for this long (0 for forever)")
+	flag.StringVar(&authMode, "auth", "token", "registration: token, or approval to also accept /request approved by admins")
+	flag.StringVar(&approvalQuota, "approvalquota", "0", "quota of users registered by approved requests, e.g. total=100GB")
+	flag.DurationVar(&approvalValidity, "approvalvalidity", 0, "validity of users registered by approved requests, e.g. 720h (0 for never expire)")
+	flag.StringVar(&approvalGroup, "approvalgroup", "", "group of users registered by approved requests")
+	flag.DurationVar(&tokenExpiry, "tokenexpiry", 7*24*time.Hour, "validity of registration tokens (0 for never expire)")
+	flag.IntVar(&expiryRemind, "expiryremind", 3, "remind users this many days before their accounts expire (0 to disable)")
+	flag.DurationVar(&notifyInterval, "notifyinterval", 50*time.Millisecond, "min interval between notifications sent to users")
+	flag.IntVar(&notifyRetries, "notifyretries", 3, "retries of a failed notification")
 	flag.StringVar(&v2rayApi, "v2rayapi", "", "v2ray api listening address")
+	flag.StringVar(&v2rayCtl, "v2rayctl", "none", "v2ray control: none, systemd or process")
+	flag.StringVar(&v2rayUnit, "v2rayunit", "v2ray", "v2ray systemd unit")
+	flag.StringVar(&v2rayAccessLog, "v2rayaccesslog", "/var/log/v2ray/access.log", "v2ray access log path")
+	flag.StringVar(&v2rayErrorLog, "v2rayerrorlog", "/var/log/v2ray/error.log", "v2ray error log path")
+	flag.StringVar(&v2rayBin, "v2raybin", "v2ray", "v2ray executable, for -v2rayctl process")
+	flag.StringVar(&v2rayConfig, "v2rayconfig", "/usr/local/etc/v2ray/config.json", "v2ray config, for -v2rayctl process")
 	flag.StringVar(&inboundTag, "vmesstag", "", "vmess inbound tag")
 	flag.IntVar(&vmessClientPort, "vmessclientport", 443, "vmess client port")
 	flag.IntVar(&vmessPort, "vmessport", 12345, "vmess listening port")
 	flag.StringVar(&vmessAddress, "vmessaddr", "", "vmess address")
 	flag.StringVar(&wsPath, "wspath", "", "websocket path")
+	flag.StringVar(&vmessTransport, "vmesstransport", "", "vmess inbound options (default websocket on 127.0.0.1)")
+	flag.StringVar(&vlessTransport, "vlesstransport", "", "vless inbound options (default websocket on 127.0.0.1)")
+	flag.StringVar(&trojanTransport, "trojantransport", "", "trojan inbound options (default websocket on 127.0.0.1)")
+	flag.StringVar(&vlessTag, "vlesstag", "", "vless inbound tag (empty to disable vless)")
+	flag.IntVar(&vlessPort, "vlessport", 12346, "vless listening port")
+	flag.StringVar(&vlessWsPath, "vlesswspath", "", "vless websocket path")
+	flag.StringVar(&trojanTag, "trojantag", "", "trojan inbound tag (empty to disable trojan)")
+	flag.IntVar(&trojanPort, "trojanport", 12347, "trojan listening port")
+	flag.StringVar(&trojanWsPath, "trojanwspath", "", "trojan websocket path")
+	flag.StringVar(&ssTag, "sstag", "", "shadowsocks inbound tag prefix (empty to disable shadowsocks)")
+	flag.StringVar(&ssListen, "sslisten", "0.0.0.0", "shadowsocks listening address")
+	flag.IntVar(&ssPortMin, "ssportmin", 20000, "shadowsocks port range start")
+	flag.IntVar(&ssPortMax, "ssportmax", 20999, "shadowsocks port range end")
+	flag.StringVar(&ssCipher, "sscipher", "chacha20-ietf-poly1305", "shadowsocks cipher")
+	flag.StringVar(&ssPlugin, "ssplugin", "", "shadowsocks plugin in ss links")
 }
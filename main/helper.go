@@ -1,7 +1,15 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/Project-Nessie/nessielight"
+	"github.com/Project-Nessie/nessielight/tgolf"
 	"github.com/yanzay/tbot/v2"
 )
 
@@ -9,8 +17,10 @@ func withPrivate(from *tbot.User, chat tbot.Chat) bool {
 	return from != nil && chat.Type == "private"
 }
 
-func withAdmin(from *tbot.User, chat tbot.Chat) bool {
-	return from != nil && isAdmin(from.ID)
+func withPermission(perm nessielight.Permission) func(from *tbot.User, chat tbot.Chat) bool {
+	return func(from *tbot.User, chat tbot.Chat) bool {
+		return from != nil && nessielight.HasPermission(from.ID, perm)
+	}
 }
 
 func withAuth(from *tbot.User, chat tbot.Chat) bool {
@@ -43,3 +53,95 @@ func GetUserByTid(id int) (nessielight.User, error) {
 	}
 	return user, nil
 }
+
+// keep the tail of a long text, since telegram messages are limited to 4096 characters
+func truncate(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return "..." + string(runes[len(runes)-max:])
+}
+
+// first moment of the month containing t
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// tbot uploads files only from disk, so generated content is written to
+// a temporary file named name first
+func withTempFile(name string, content []byte, f func(path string) error) error {
+	dir, err := os.MkdirTemp("", "nessielight")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		return err
+	}
+	return f(path)
+}
+
+// send generated content as a document named name
+func sendDocument(server *tgolf.Server, chatid string, name string, content []byte, caption string) error {
+	return withTempFile(name, content, func(path string) error {
+		_, err := server.Client.SendDocumentFile(chatid, path, tbot.OptCaption(caption))
+		return err
+	})
+}
+
+// send generated image as a photo with html caption
+func sendPhoto(server *tgolf.Server, chatid string, name string, content []byte, caption string) error {
+	return withTempFile(name, content, func(path string) error {
+		_, err := server.Client.SendPhotoFile(chatid, path, tbot.OptCaption(caption), tbot.OptParseModeHTML)
+		return err
+	})
+}
+
+// parse duration like time.ParseDuration, also accepting days like "30d"
+func parseDuration(text string) (time.Duration, error) {
+	if strings.HasSuffix(text, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(text, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", text)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(text)
+}
+
+func expiryText(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+// parse expiry entered by admins: a date like "2006-01-02" in local time, a
+// duration from now like "30d", or "0" for never
+func parseExpiry(text string, now time.Time) (time.Time, error) {
+	if text == "0" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", text, time.Local); err == nil {
+		return t, nil
+	}
+	d, err := parseDuration(text)
+	if err != nil || d <= 0 {
+		return time.Time{}, fmt.Errorf("invalid expiry %s", text)
+	}
+	return now.Add(d), nil
+}
+
+// mark errors of sending to a user who blocked the bot or does not exist as
+// permanent, so the notifier does not retry them
+func sendError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if msg := err.Error(); strings.HasPrefix(msg, "Forbidden:") || strings.Contains(msg, "chat not found") {
+		return &nessielight.PermanentError{Err: err}
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Project-Nessie/nessielight"
+	"github.com/Project-Nessie/nessielight/tgolf"
+	"github.com/yanzay/tbot/v2"
+)
+
+// add background jobs to nessielight.SchedulerInstance by schedule flags
+func registerJobs(server *tgolf.Server) {
+	addJob := func(name, schedule string, run func(now time.Time) error) {
+		s, err := nessielight.ParseSchedule(schedule)
+		if err != nil {
+			log.Fatalf("invalid schedule of job %s: %v", name, err)
+		}
+		nessielight.SchedulerInstance.Add(name, s, run)
+	}
+	addJob("traffic", trafficSchedule, func(now time.Time) error {
+		if err := nessielight.V2rayUpdateUserTraffic(); err != nil {
+			return err
+		}
+		return nessielight.CompactTrafficHistory()
+	})
+	addJob("quota", quotaSchedule, func(now time.Time) error {
+		if err := nessielight.CheckBillingCycles(now); err != nil {
+			return err
+		}
+		return nessielight.CheckQuotas()
+	})
+	addJob("expiry", expirySchedule, func(now time.Time) error {
+		return checkExpiry(server, now)
+	})
+	if reportSchedule != "" {
+		// the first report covers the last 24h
+		var last time.Time
+		addJob("report", reportSchedule, func(now time.Time) error {
+			since := last
+			if since.IsZero() {
+				since = now.Add(-24 * time.Hour)
+			}
+			if err := sendTrafficReport(server, since, now); err != nil {
+				return err
+			}
+			last = now
+			return nil
+		})
+	}
+
+	server.RegisterInlineButton("a/service/jobs", withPermission(nessielight.PermServiceStatus), func(cq *tbot.CallbackQuery) error {
+		msg := "<b>Jobs</b>\n"
+		for _, v := range nessielight.SchedulerInstance.Status() {
+			msg += fmt.Sprintf("\n<b>%s</b> %s, %d runs\n", v.Name, html.EscapeString(v.Schedule), v.Runs)
+			switch {
+			case v.Running:
+				msg += "running\n"
+			case v.LastRun.IsZero():
+				msg += "never run\n"
+			default:
+				msg += fmt.Sprintf("last run %s, took %v\n", v.LastRun.Local().Format("2006-01-02 15:04:05"),
+					v.LastDuration.Round(time.Millisecond))
+			}
+			if v.LastError != "" {
+				msg += fmt.Sprintf("error: %s\n", html.EscapeString(v.LastError))
+			}
+			if !v.NextRun.IsZero() {
+				msg += fmt.Sprintf("next run %s\n", v.NextRun.Local().Format("2006-01-02 15:04:05"))
+			}
+		}
+		server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{
+			{{Text: "Refresh", CallbackData: "a/service/jobs"}},
+			{{Text: "Go Back", CallbackData: "a/service"}},
+		}, "%s", truncate(msg, 3500))
+		return nil
+	})
+}
+
+// send traffic history between since and until to users who can view traffic
+func sendTrafficReport(server *tgolf.Server, since, until time.Time) error {
+	msg, err := trafficHistoryText("report", since, until)
+	if err != nil {
+		return err
+	}
+	msg = fmt.Sprintf("<b>Traffic Report</b>\n%s - %s\n\n%s", since.Local().Format("2006-01-02 15:04"),
+		until.Local().Format("2006-01-02 15:04"), msg)
+	ids, err := nessielight.UsersWithPermission(nessielight.PermTrafficView)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := server.Sendf(strconv.Itoa(id), "%s", truncate(msg, 3500)); err != nil {
+			return fmt.Errorf("send report to %d: %v", id, err)
+		}
+	}
+	return nil
+}
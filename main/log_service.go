@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Project-Nessie/nessielight"
+	"github.com/Project-Nessie/nessielight/tgolf"
+	"github.com/yanzay/tbot/v2"
+)
+
+// lines per page of log viewer
+const logPageSize = 20
+
+// layout of time range entered by admins
+const logTimeLayout = "2006-01-02 15:04"
+
+// log page currently viewed by an admin
+type logView struct {
+	name   string
+	path   string
+	filter nessielight.LogFilter
+	// number of newest lines skipped
+	skip int
+}
+
+var logViews = struct {
+	sync.Mutex
+	m map[int]*logView
+}{m: make(map[int]*logView)}
+
+func logPath(name string) string {
+	if name == "error" {
+		return nessielight.V2rayErrorLog
+	}
+	return nessielight.V2rayAccessLog
+}
+
+func registerLogService(server *tgolf.Server) {
+	logBtns := [][]tbot.InlineKeyboardButton{
+		{{Text: "Access Log", CallbackData: "a/log/access"}, {Text: "Error Log", CallbackData: "a/log/error"}},
+		{{Text: "Search Log", CallbackData: "a/log/search"}},
+		{{Text: "Download Access Log", CallbackData: "a/log/download/access"}},
+		{{Text: "Download Error Log", CallbackData: "a/log/download/error"}},
+		{{Text: "Go Back", CallbackData: "a/service"}},
+	}
+	pageBtns := [][]tbot.InlineKeyboardButton{
+		{{Text: "« Older", CallbackData: "a/log/older"}, {Text: "Newer »", CallbackData: "a/log/newer"}},
+		{{Text: "Download", CallbackData: "a/log/download"}, {Text: "Go Back", CallbackData: "a/service/v2raylog"}},
+	}
+
+	// render the current page of an admin
+	showPage := func(adminID int) (string, error) {
+		logViews.Lock()
+		if logViews.m[adminID] == nil {
+			logViews.Unlock()
+			return "", fmt.Errorf("no log is being viewed")
+		}
+		view := *logViews.m[adminID]
+		logViews.Unlock()
+		lines, total, err := nessielight.ReadV2rayLog(view.path, view.filter, view.skip, logPageSize)
+		if err != nil {
+			return "", err
+		}
+		// stay on the oldest page
+		if view.skip >= total && total > 0 {
+			view.skip = (total - 1) / logPageSize * logPageSize
+			lines, total, err = nessielight.ReadV2rayLog(view.path, view.filter, view.skip, logPageSize)
+			if err != nil {
+				return "", err
+			}
+			logViews.Lock()
+			if v := logViews.m[adminID]; v != nil {
+				v.skip = view.skip
+			}
+			logViews.Unlock()
+		}
+		msg := fmt.Sprintf("<b>%s log</b>, %d-%d of %d matched lines from the newest\n",
+			view.name, view.skip+1, view.skip+len(lines), total)
+		body := ""
+		for _, line := range lines {
+			body += truncate(line, 160) + "\n"
+		}
+		if body == "" {
+			body = "(empty)"
+		}
+		return msg + "<pre>" + html.EscapeString(truncate(body, 3500)) + "</pre>", nil
+	}
+
+	openLog := func(cq *tbot.CallbackQuery, name string, filter nessielight.LogFilter) error {
+		path := logPath(name)
+		if path == "" {
+			server.EditCallbackMsgWithBtn(cq, logBtns, "<i>path of %s log is not configured</i>", name)
+			return nil
+		}
+		logViews.Lock()
+		logViews.m[cq.From.ID] = &logView{name: name, path: path, filter: filter}
+		logViews.Unlock()
+		msg, err := showPage(cq.From.ID)
+		if err != nil {
+			return err
+		}
+		server.EditCallbackMsgWithBtn(cq, pageBtns, msg)
+		return nil
+	}
+
+	sendLog := func(chatid string, name string) error {
+		path := logPath(name)
+		if path == "" {
+			server.Sendf(chatid, "<i>path of %s log is not configured</i>", name)
+			return nil
+		}
+		if _, err := server.Client.SendDocumentFile(chatid, path, tbot.OptCaption(name+" log")); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	server.RegisterInlineButton("a/service/v2raylog", withPermission(nessielight.PermLogView), func(cq *tbot.CallbackQuery) error {
+		server.EditCallbackMsgWithBtn(cq, logBtns, "<b>V2ray Log</b>\naccess: <code>%s</code>\nerror: <code>%s</code>",
+			html.EscapeString(nessielight.V2rayAccessLog), html.EscapeString(nessielight.V2rayErrorLog))
+		return nil
+	})
+	server.RegisterInlineButton("a/log/access", withPermission(nessielight.PermLogView), func(cq *tbot.CallbackQuery) error {
+		return openLog(cq, "access", nessielight.LogFilter{})
+	})
+	server.RegisterInlineButton("a/log/error", withPermission(nessielight.PermLogView), func(cq *tbot.CallbackQuery) error {
+		return openLog(cq, "error", nessielight.LogFilter{})
+	})
+	turnPage := func(cq *tbot.CallbackQuery, delta int) error {
+		logViews.Lock()
+		view := logViews.m[cq.From.ID]
+		if view != nil {
+			view.skip += delta
+			if view.skip < 0 {
+				view.skip = 0
+			}
+		}
+		logViews.Unlock()
+		msg, err := showPage(cq.From.ID)
+		if err != nil {
+			return err
+		}
+		server.EditCallbackMsgWithBtn(cq, pageBtns, msg)
+		return nil
+	}
+	server.RegisterInlineButton("a/log/older", withPermission(nessielight.PermLogView), func(cq *tbot.CallbackQuery) error {
+		return turnPage(cq, logPageSize)
+	})
+	server.RegisterInlineButton("a/log/newer", withPermission(nessielight.PermLogView), func(cq *tbot.CallbackQuery) error {
+		return turnPage(cq, -logPageSize)
+	})
+	server.RegisterInlineButton("a/log/download", withPermission(nessielight.PermLogView), func(cq *tbot.CallbackQuery) error {
+		logViews.Lock()
+		view := logViews.m[cq.From.ID]
+		logViews.Unlock()
+		if view == nil {
+			return fmt.Errorf("no log is being viewed")
+		}
+		return sendLog(cq.Message.Chat.ID, view.name)
+	})
+	server.RegisterInlineButton("a/log/download/access", withPermission(nessielight.PermLogView), func(cq *tbot.CallbackQuery) error {
+		return sendLog(cq.Message.Chat.ID, "access")
+	})
+	server.RegisterInlineButton("a/log/download/error", withPermission(nessielight.PermLogView), func(cq *tbot.CallbackQuery) error {
+		return sendLog(cq.Message.Chat.ID, "error")
+	})
+
+	validTime := func(value string) bool {
+		if value == "-" {
+			return true
+		}
+		_, err := time.ParseInLocation(logTimeLayout, value, time.Local)
+		return err == nil
+	}
+	server.Register(">>>log/search", "", withPermission(nessielight.PermLogView), []tgolf.Parameter{
+		tgolf.NewParam("log", "log to search: access or error", func(value string) bool {
+			return value == "access" || value == "error"
+		}),
+		tgolf.NewParam("user", "telegram id of user, or - for all users (access log only)", func(value string) bool {
+			if value == "-" {
+				return true
+			}
+			id, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return false
+			}
+			user, err := GetUserByTid(int(id))
+			return err == nil && user != nil
+		}),
+		tgolf.NewParam("level", "level: debug, info, warning or error, or - for all levels (error log only)", func(value string) bool {
+			switch strings.ToLower(value) {
+			case "-", "debug", "info", "warning", "error":
+				return true
+			}
+			return false
+		}),
+		tgolf.NewParam("since", "start time like <code>2022-05-28 08:00</code>, or -", validTime),
+		tgolf.NewParam("until", "end time like <code>2022-05-28 20:00</code>, or -", validTime),
+	}, func(argv []tgolf.Argument, from *tbot.User, chatid string) {
+		name := argv[0].Value
+		var filter nessielight.LogFilter
+		if argv[1].Value != "-" {
+			id, _ := strconv.ParseInt(argv[1].Value, 10, 32)
+			user, err := GetUserByTid(int(id))
+			if err != nil || user == nil {
+				server.Sendf(chatid, "user not found")
+				return
+			}
+			filter.Emails = nessielight.UserEmails(user)
+		}
+		if argv[2].Value != "-" {
+			filter.Level = argv[2].Value
+		}
+		if argv[3].Value != "-" {
+			filter.Since, _ = time.ParseInLocation(logTimeLayout, argv[3].Value, time.Local)
+		}
+		if argv[4].Value != "-" {
+			filter.Until, _ = time.ParseInLocation(logTimeLayout, argv[4].Value, time.Local)
+			// include the whole minute
+			filter.Until = filter.Until.Add(time.Minute - time.Second)
+		}
+		path := logPath(name)
+		if path == "" {
+			server.Sendf(chatid, "<i>path of %s log is not configured</i>", name)
+			return
+		}
+		logViews.Lock()
+		logViews.m[from.ID] = &logView{name: name, path: path, filter: filter}
+		logViews.Unlock()
+		msg, err := showPage(from.ID)
+		if err != nil {
+			server.Sendf(chatid, "search failed: %s", html.EscapeString(err.Error()))
+			return
+		}
+		server.SendfWithBtn(chatid, pageBtns, msg)
+	})
+	server.RegisterInlineButton("a/log/search", withPermission(nessielight.PermLogView), func(cq *tbot.CallbackQuery) error {
+		server.EditCallbackBtn(cq, [][]tbot.InlineKeyboardButton{})
+		return server.StartCommand(">>>log/search", cq.From, cq.Message.Chat)
+	})
+}
@@ -7,10 +7,10 @@ import (
 )
 
 func registerLoginService(server *tgolf.Server) {
-	server.Register("/register", "Register yourself", combineInit(withPrivate, func(from *tbot.User, chat tbot.Chat) bool {
+	check := combineInit(withPrivate, func(from *tbot.User, chat tbot.Chat) bool {
 		user, err := nessielight.UserManagerInstance.FindUserByTelegramID(from.ID)
 		if err != nil {
-			server.Sendf(chat.ID, err.Error())
+			server.Sendf(chat.ID, "%s", err.Error())
 			return false
 		}
 		if user != nil {
@@ -18,9 +18,11 @@ func registerLoginService(server *tgolf.Server) {
 			return false
 		}
 		return true
-	}), []tgolf.Parameter{
+	})
+	params := []tgolf.Parameter{
 		tgolf.NewParam("token", "token", nil),
-	}, func(argv []tgolf.Argument, from *tbot.User, chatid string) {
+	}
+	register := func(argv []tgolf.Argument, from *tbot.User, chatid string) {
 		token := argv[0].Value
 		user, err := nessielight.AuthServiceInstance.Register(token, from.ID)
 		if err != nil {
@@ -36,5 +38,8 @@ func registerLoginService(server *tgolf.Server) {
 			return
 		}
 		server.Sendf(chatid, "Register succeed.")
-	})
+	}
+	server.Register("/register", "Register yourself", check, params, register)
+	// registration link https://t.me/<bot>?start=<token> sends "/start <token>"
+	server.Register("/start", "Register by link", check, params, register)
 }
@@ -3,8 +3,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/Project-Nessie/nessielight"
 	"github.com/Project-Nessie/nessielight/tgolf"
@@ -18,35 +23,173 @@ func main() {
 	flag.Parse()
 
 	// nessielight
+	nessielight.TrafficHistory = nessielight.TrafficHistoryConfig{
+		RawRetention: historyRaw,
+		Step:         historyStep,
+		Retention:    historyRetention,
+	}
+	nessielight.BillingCycleDay = cycleDay
+	if clashRules != "" {
+		rules, err := nessielight.LoadClashRules(clashRules)
+		if err != nil {
+			log.Fatal(err)
+		}
+		nessielight.ClashRules = rules
+	}
+	nessielight.V2rayAccessLog = v2rayAccessLog
+	nessielight.V2rayErrorLog = v2rayErrorLog
+	if cycleDay < 0 || cycleDay > 31 {
+		log.Fatalf("invalid cycleday %d", cycleDay)
+	}
 	if err := nessielight.InitDBwithFile("test.db"); err != nil {
 		log.Fatal(err)
 	}
-	if err := nessielight.InitV2rayService(inboundTag, vmessPort, vmessClientPort, vmessAddress, wsPath, v2rayApi); err != nil {
+	owners := make([]int, 0, len(admins))
+	for _, v := range admins {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid admin %s", v)
+		}
+		owners = append(owners, id)
+	}
+	if err := nessielight.BootstrapOwners(owners); err != nil {
+		log.Fatal(err)
+	}
+	switch authMode {
+	case "token":
+	case "approval":
+		quota, err := nessielight.ParseTrafficQuota(approvalQuota)
+		if err != nil {
+			log.Fatal(err)
+		}
+		nessielight.InitApprovalAuthService(nessielight.UserPreset{Quota: quota, Validity: approvalValidity, Group: approvalGroup})
+	default:
+		log.Fatalf("unknown auth %s", authMode)
+	}
+	switch v2rayCtl {
+	case "none":
+	case "systemd":
+		nessielight.InitSystemdService(v2rayUnit)
+	case "process":
+		nessielight.InitProcessService(v2rayBin, "-config", v2rayConfig)
+		if err := nessielight.SystemCtlServiceInstance.StartV2rayServer(); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown v2rayctl %s", v2rayCtl)
+	}
+	vmess, err := nessielight.ParseInboundOptions(vmessTransport, vmessPort, wsPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := nessielight.InitV2rayService(inboundTag, vmess, vmessClientPort, vmessAddress, v2rayApi); err != nil {
+		log.Fatal(err)
+	}
+	if vlessTag != "" {
+		vless, err := nessielight.ParseInboundOptions(vlessTransport, vlessPort, vlessWsPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := nessielight.InitVlessInbound(vlessTag, vless); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if trojanTag != "" {
+		trojan, err := nessielight.ParseInboundOptions(trojanTransport, trojanPort, trojanWsPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := nessielight.InitTrojanInbound(trojanTag, trojan); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if ssTag != "" {
+		if err := nessielight.InitShadowsocks(ssTag, ssListen, ssPortMin, ssPortMax, ssCipher, ssPlugin); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// traffic collected before a crash
+	if err := nessielight.ReplayTrafficJournal(); err != nil {
+		log.Fatal(err)
+	}
+	// expired while stopped
+	if err := nessielight.CheckExpiry(time.Now()); err != nil {
 		log.Fatal(err)
 	}
 	if err := nessielight.Restore(); err != nil {
 		log.Fatal(err)
 	}
+	if subListen != "" {
+		startSubscriptionServer()
+	}
 
 	// tgolf server
 	server := tgolf.NewServer(botToken, webhookUrl, listenAddr)
+	if callbackSecret != "" {
+		server.SetCallbackSecret([]byte(callbackSecret))
+	}
+	if me, err := server.Client.GetMe(); err != nil {
+		logger.Print("get bot info: ", err)
+	} else {
+		nessielight.TelegramBotName = me.Username
+	}
 	server.Register("/hello", "Hello!", nil, nil, func(argv []tgolf.Argument, from *tbot.User, chatid string) {
 		if from == nil {
 			server.Sendf(chatid, "invalid interaction")
 			return
 		}
 		user, _ := GetUserByTid(from.ID)
-		server.Sendf(chatid, "Hello!\nYour ID: <code>%d</code>\nAdministration: <b>%v</b>\nRegistered: <b>%v</b>",
-			from.ID, isAdmin(from.ID), user != nil)
+		role, _ := nessielight.RoleOf(from.ID)
+		msg := fmt.Sprintf("Hello!\nYour ID: <code>%d</code>\nRole: <b>%s</b>\nRegistered: <b>%v</b>",
+			from.ID, role, user != nil)
+		if user != nil {
+			msg += fmt.Sprintf("\nExpires: <b>%s</b>", remainingText(user, time.Now()))
+		}
+		server.Sendf(chatid, "%s", msg)
 	})
 
+	notifier, err := nessielight.NewNotifier(func(tid int, text string) error {
+		_, err := server.Sendf(strconv.Itoa(tid), "%s", text)
+		return sendError(err)
+	}, notifyInterval, notifyRetries)
+	if err != nil {
+		log.Fatal(err)
+	}
+	nessielight.NotifierInstance = notifier
+	notifier.Start()
+
 	registerAdminService(&server)
+	registerLogService(&server)
+	registerBillingService(&server)
+	registerSubscriptionService(&server)
 	registerProxyService(&server)
 	registerLoginService(&server)
+	registerRequestService(&server)
+
+	registerJobs(&server)
+	nessielight.SchedulerInstance.Start()
+
+	// stop cleanly, letting running jobs and the message being sent finish
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		logger.Printf("received %v, stopping", sig)
+		nessielight.SchedulerInstance.Stop()
+		notifier.Stop()
+		if err := nessielight.V2rayUpdateUserTraffic(); err != nil {
+			logger.Print("collect traffic: ", err)
+		}
+		if err := nessielight.StopChildV2ray(); err != nil {
+			logger.Print("stop v2ray: ", err)
+		}
+		server.Stop()
+	}()
 
 	if err := server.Start(); err != nil {
 		log.Fatal(err)
 	}
+	logger.Printf("Nessielight stopped.")
 }
 
 func init() {
@@ -2,8 +2,13 @@ package main
 
 import (
 	"fmt"
+	"html"
+	"strings"
+	"time"
+	"unicode/utf16"
 
 	"github.com/Project-Nessie/nessielight"
+	"github.com/Project-Nessie/nessielight/qrcode"
 	"github.com/Project-Nessie/nessielight/tgolf"
 	"github.com/yanzay/tbot/v2"
 )
@@ -13,26 +18,32 @@ func registerProxyService(server *tgolf.Server) {
 		{{Text: "Get Configs", CallbackData: "p/get"}},
 		{{Text: "Update Configs", CallbackData: "p/upd"}},
 		{{Text: "Get Statistics", CallbackData: "p/stat"}},
+		{{Text: "Billing Cycles", CallbackData: "p/cycles"}},
+		{{Text: "Subscription", CallbackData: "p/sub"}, {Text: "Client Configs", CallbackData: "p/client"}},
+		{{Text: "Preferences", CallbackData: "p/pref"}},
 	}
 	server.Register("/proxy", "Proxy Control", combineInit(withPrivate, withAuth), nil,
 		func(argv []tgolf.Argument, from *tbot.User, chatid string) {
-			server.SendfWithBtn(chatid, proxyBtns, "<b>Proxy Control</b>\nYour User ID: %d", from.ID)
+			server.SendfWithBtn(chatid, proxyBtns, "%s", proxyControlText(from.ID))
 		})
 
-	server.RegisterInlineButton("p/back", func(cq *tbot.CallbackQuery) error {
-		server.EditCallbackMsgWithBtn(cq, proxyBtns, "<b>Proxy Control</b>\nYour User ID: %d", cq.From.ID)
+	server.RegisterInlineButton("p/back", withAuth, func(cq *tbot.CallbackQuery) error {
+		server.EditCallbackMsgWithBtn(cq, proxyBtns, "%s", proxyControlText(cq.From.ID))
 		return nil
 	})
-	server.RegisterInlineButton("p/get", func(cq *tbot.CallbackQuery) error {
+	server.RegisterInlineButton("p/get", withAuth, func(cq *tbot.CallbackQuery) error {
 		user, err := GetUserByTid(cq.From.ID)
 		if err != nil {
 			return err
 		}
+		if user.Suspension() != "" {
+			server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{}, suspensionMessage(user))
+			return nil
+		}
 		nessielight.ApplyUserProxy(user)
-		server.Sendf(cq.Message.Chat.ID, nessielight.GetUserProxyMessage(user))
-		return nil
+		return sendUserProxies(server, cq.Message.Chat.ID, user)
 	})
-	server.RegisterInlineButton("p/upd", func(cq *tbot.CallbackQuery) error {
+	server.RegisterInlineButton("p/upd", withAuth, func(cq *tbot.CallbackQuery) error {
 		if err := nessielight.V2rayUpdateUserTraffic(); err != nil {
 			return err
 		}
@@ -40,11 +51,14 @@ func registerProxyService(server *tgolf.Server) {
 		if err != nil {
 			return err
 		}
+		if user.Suspension() != "" {
+			server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{}, suspensionMessage(user))
+			return nil
+		}
 		for _, p := range user.Proxy() {
 			p.Deactivate()
 		}
-		proxy := nessielight.V2rayServiceInstance.NewProxy()
-		if err := user.SetProxy([]nessielight.Proxy{proxy}); err != nil {
+		if err := user.SetProxy(nessielight.NewUserProxies()); err != nil {
 			return err
 		}
 		if err := nessielight.ApplyUserProxy(user); err != nil {
@@ -54,11 +68,10 @@ func registerProxyService(server *tgolf.Server) {
 			return err
 		}
 		server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{}, "Proxy has updated.")
-		server.Sendf(cq.Message.Chat.ID, nessielight.GetUserProxyMessage(user))
-		return nil
+		return sendUserProxies(server, cq.Message.Chat.ID, user)
 	})
 
-	server.RegisterInlineButton("p/stat", func(cq *tbot.CallbackQuery) error {
+	server.RegisterInlineButton("p/stat", withAuth, func(cq *tbot.CallbackQuery) error {
 		user, err := GetUserByTid(cq.From.ID)
 		if err != nil {
 			return err
@@ -66,9 +79,187 @@ func registerProxyService(server *tgolf.Server) {
 		if err := nessielight.V2rayUpdateUserTraffic(); err != nil {
 			return err
 		}
+		now := time.Now()
+		day, err := nessielight.SumTrafficHistory(user.TelegramID(), now.Add(-24*time.Hour), now)
+		if err != nil {
+			return err
+		}
+		month, err := nessielight.SumTrafficHistory(user.TelegramID(), monthStart(now), now)
+		if err != nil {
+			return err
+		}
 		traffic := user.Traffic()
 		server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{},
-			fmt.Sprintf("down <b>%v</b> up <b>%v</b>\n", traffic.Downlink, traffic.Uplink))
+			fmt.Sprintf("this cycle: down <b>%v</b> up <b>%v</b>\nlast 24h: down <b>%v</b> up <b>%v</b>\n"+
+				"this month: down <b>%v</b> up <b>%v</b>\nquota <b>%v</b>\n",
+				traffic.Downlink, traffic.Uplink, day.Downlink, day.Uplink, month.Downlink, month.Uplink, user.Quota()))
+		return nil
+	})
+
+	showPref := func(cq *tbot.CallbackQuery, user nessielight.User) {
+		format := user.Preference(nessielight.PrefProxyFormat)
+		if format == "" {
+			format = nessielight.ProxyFormatText
+		}
+		msg := fmt.Sprintf("<b>Preferences</b>\nproxy format: <b>%s</b>\nnotifications:", format)
+		btns := [][]tbot.InlineKeyboardButton{
+			{{Text: "Links as Text", CallbackData: "p/pref/text"}, {Text: "Links as QR Code", CallbackData: "p/pref/qrcode"}},
+		}
+		for _, category := range notifyCategories(user.TelegramID()) {
+			state, toggle := "on", "Off"
+			if !category.Enabled(user) {
+				state, toggle = "off", "On"
+			}
+			msg += fmt.Sprintf(" %s <b>%s</b>", category, state)
+			btns = append(btns, []tbot.InlineKeyboardButton{{
+				Text:         fmt.Sprintf("Turn %s %s Notifications", toggle, category),
+				CallbackData: "p/pref/notify/" + string(category),
+			}})
+		}
+		btns = append(btns, []tbot.InlineKeyboardButton{{Text: "Go Back", CallbackData: "p/back"}})
+		server.EditCallbackMsgWithBtn(cq, btns, "%s", msg)
+	}
+	server.RegisterInlineButton("p/pref", withAuth, func(cq *tbot.CallbackQuery) error {
+		user, err := GetUserByTid(cq.From.ID)
+		if err != nil {
+			return err
+		}
+		showPref(cq, user)
+		return nil
+	})
+	for _, format := range []string{nessielight.ProxyFormatText, nessielight.ProxyFormatQRCode} {
+		format := format
+		server.RegisterInlineButton("p/pref/"+format, withAuth, func(cq *tbot.CallbackQuery) error {
+			user, err := GetUserByTid(cq.From.ID)
+			if err != nil {
+				return err
+			}
+			if err := user.SetPreference(nessielight.PrefProxyFormat, format); err != nil {
+				return err
+			}
+			if err := nessielight.UserManagerInstance.SetUser(user); err != nil {
+				return err
+			}
+			showPref(cq, user)
+			return nil
+		})
+	}
+
+	server.RegisterInlineButtonPrefix("p/pref/notify/", withAuth, func(cq *tbot.CallbackQuery) error {
+		category := nessielight.NotifyCategory(strings.TrimPrefix(cq.Data, "p/pref/notify/"))
+		valid := false
+		for _, v := range notifyCategories(cq.From.ID) {
+			valid = valid || v == category
+		}
+		if !valid {
+			return fmt.Errorf("unknown notification category %s", category)
+		}
+		user, err := GetUserByTid(cq.From.ID)
+		if err != nil {
+			return err
+		}
+		value := nessielight.NotifyOff
+		if !category.Enabled(user) {
+			value = ""
+		}
+		if err := user.SetPreference(category.PrefKey(), value); err != nil {
+			return err
+		}
+		if err := nessielight.UserManagerInstance.SetUser(user); err != nil {
+			return err
+		}
+		showPref(cq, user)
+		return nil
+	})
+
+	clientBtns := [][]tbot.InlineKeyboardButton{
+		{{Text: "Clash", CallbackData: "p/client/clash"}, {Text: "Clash.Meta", CallbackData: "p/client/clashmeta"}},
+		{{Text: "sing-box", CallbackData: "p/client/singbox"}, {Text: "v2ray", CallbackData: "p/client/v2ray"}},
+		{{Text: "Go Back", CallbackData: "p/back"}},
+	}
+	server.RegisterInlineButton("p/client", withAuth, func(cq *tbot.CallbackQuery) error {
+		server.EditCallbackMsgWithBtn(cq, clientBtns, "<b>Client Configs</b>\nready-to-run configs containing all your proxies")
 		return nil
 	})
+	for format := range clientConfigs {
+		format := format
+		server.RegisterInlineButton("p/client/"+format, withAuth, func(cq *tbot.CallbackQuery) error {
+			user, err := GetUserByTid(cq.From.ID)
+			if err != nil {
+				return err
+			}
+			if user.Suspension() != "" {
+				server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{}, suspensionMessage(user))
+				return nil
+			}
+			config, err := clientConfigs[format].generate(user)
+			if err != nil {
+				return err
+			}
+			return sendDocument(server, cq.Message.Chat.ID, clientConfigs[format].filename, []byte(config),
+				clientConfigs[format].caption)
+		})
+	}
+}
+
+// max UTF-16 units of a photo caption, excluding html tags
+const photoCaptionLimit = 1024
+
+// send proxies of a user in the format of user preference
+func sendUserProxies(server *tgolf.Server, chatid string, user nessielight.User) error {
+	if user.Preference(nessielight.PrefProxyFormat) != nessielight.ProxyFormatQRCode {
+		_, err := server.Sendf(chatid, "%s", nessielight.GetUserProxyMessage(user))
+		return err
+	}
+	for _, p := range user.Proxy() {
+		link := p.Link()
+		img, err := qrcode.PNG(link, 8)
+		if err != nil {
+			return err
+		}
+		caption := "<code>" + html.EscapeString(link) + "</code>"
+		// telegram rejects photos with long captions, send such links separately
+		if len(utf16.Encode([]rune(link))) > photoCaptionLimit {
+			caption = ""
+		}
+		if err := sendPhoto(server, chatid, "proxy.png", img, caption); err != nil {
+			return err
+		}
+		if caption == "" {
+			if _, err := server.Sendf(chatid, "<code>%s</code>", html.EscapeString(link)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// notification categories a user can opt out of, NotifyAdmin only for admins
+func notifyCategories(tid int) []nessielight.NotifyCategory {
+	var categories []nessielight.NotifyCategory
+	for _, v := range nessielight.NotifyCategories {
+		if v != nessielight.NotifyAdmin || nessielight.HasPermission(tid, nessielight.PermUserEdit) {
+			categories = append(categories, v)
+		}
+	}
+	return categories
+}
+
+// header of Proxy Control
+func proxyControlText(tid int) string {
+	msg := fmt.Sprintf("<b>Proxy Control</b>\nYour User ID: %d", tid)
+	if user, err := GetUserByTid(tid); err == nil && user != nil {
+		msg += fmt.Sprintf("\nExpires: <b>%s</b>", remainingText(user, time.Now()))
+	}
+	return msg
+}
+
+func suspensionMessage(user nessielight.User) string {
+	switch user.Suspension() {
+	case nessielight.SuspendedByQuota:
+		return fmt.Sprintf("Your account is suspended since traffic exceeds quota <b>%v</b>. Please contact admin.", user.Quota())
+	case nessielight.SuspendedByExpiry:
+		return fmt.Sprintf("Your account %s. Please contact admin to extend it.", remainingText(user, time.Now()))
+	}
+	return "Your account is suspended. Please contact admin."
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Project-Nessie/nessielight"
+	"github.com/Project-Nessie/nessielight/tgolf"
+	"github.com/v2fly/v2ray-core/v4/app/proxyman/command"
+	"github.com/yanzay/tbot/v2"
+	"google.golang.org/grpc"
+)
+
+// v2ray handler service accepting inbounds and users
+type testHandlerService struct {
+	command.UnimplementedHandlerServiceServer
+}
+
+func (testHandlerService) AddInbound(context.Context, *command.AddInboundRequest) (*command.AddInboundResponse, error) {
+	return &command.AddInboundResponse{}, nil
+}
+
+func (testHandlerService) AlterInbound(context.Context, *command.AlterInboundRequest) (*command.AlterInboundResponse, error) {
+	return &command.AlterInboundResponse{}, nil
+}
+
+// start a fake v2ray api and connect nessielight to it, with vmess and vless
+// inbounds on websocket
+func initTestV2ray(t *testing.T) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	command.RegisterHandlerServiceServer(s, testHandlerService{})
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	if err := nessielight.InitDBwithFile(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	vmess, err := nessielight.ParseInboundOptions("", 10001, "/vmess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nessielight.InitV2rayService("vmess", vmess, 443, "example.com", lis.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	vless, err := nessielight.ParseInboundOptions("", 10002, "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nessielight.InitVlessInbound("vless", vless); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tgolf server whose bot api records texts of sent messages
+func newTestServer(t *testing.T) (*tgolf.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var texts []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if text := r.FormValue("text"); text != "" {
+			mu.Lock()
+			texts = append(texts, text)
+			mu.Unlock()
+		}
+		w.Write([]byte(`{"ok":true,"result":{}}`))
+	}))
+	t.Cleanup(api.Close)
+	server := tgolf.NewServerFromTbot(tbot.New("token", tbot.WithBaseURL(api.URL)))
+	return &server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, texts...)
+	}
+}
+
+func TestSendUserProxiesEscapedLink(t *testing.T) {
+	initTestV2ray(t)
+	server, sent := newTestServer(t)
+
+	proxy, err := nessielight.NewProxyOf("vless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := nessielight.UserManagerInstance.NewUser(1001)
+	if err := user.SetProxy([]nessielight.Proxy{proxy}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nessielight.UserManagerInstance.SetUser(user); err != nil {
+		t.Fatal(err)
+	}
+	link := proxy.Link()
+	if !strings.Contains(link, "path=%2Fws") {
+		t.Fatalf("link %s does not contain an escaped ws path", link)
+	}
+
+	if err := sendUserProxies(server, "1001", user); err != nil {
+		t.Fatal(err)
+	}
+	texts := sent()
+	if len(texts) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(texts))
+	}
+	if !strings.Contains(texts[0], link) || strings.Contains(texts[0], "%!") {
+		t.Errorf("sent %q, want it to contain %s", texts[0], link)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/Project-Nessie/nessielight"
+	"github.com/Project-Nessie/nessielight/tgolf"
+	"github.com/yanzay/tbot/v2"
+)
+
+// registration requests approved by admins, available with -auth approval
+func registerRequestService(server *tgolf.Server) {
+	approver, enabled := nessielight.AuthServiceInstance.(nessielight.RegistrationApprover)
+
+	server.Register("/request", "Request registration from admins", combineInit(withPrivate, func(from *tbot.User, chat tbot.Chat) bool {
+		if !enabled {
+			server.Sendf(chat.ID, "Registration requests are disabled, please /register with a token")
+			return false
+		}
+		user, err := nessielight.UserManagerInstance.FindUserByTelegramID(from.ID)
+		if err != nil {
+			server.Sendf(chat.ID, "%s", html.EscapeString(err.Error()))
+			return false
+		}
+		if user != nil {
+			server.Sendf(chat.ID, "You've already registered")
+			return false
+		}
+		return true
+	}), []tgolf.Parameter{
+		tgolf.NewParam("note", "note for admins, <code>-</code> for none", nil),
+	}, func(argv []tgolf.Argument, from *tbot.User, chatid string) {
+		note := argv[0].Value
+		if note == "-" {
+			note = ""
+		}
+		req, err := approver.SubmitRequest(nessielight.RegisterRequest{
+			TelegramID: from.ID,
+			Username:   from.Username,
+			Name:       strings.TrimSpace(from.FirstName + " " + from.LastName),
+			Note:       note,
+		})
+		if err != nil {
+			server.Sendf(chatid, "request failed: %s", html.EscapeString(err.Error()))
+			return
+		}
+		reviewers, err := nessielight.UsersWithPermission(nessielight.PermRequestReview)
+		if err != nil {
+			logger.Print("reviewers: ", err)
+		}
+		for _, v := range reviewers {
+			if _, err := server.SendfWithBtn(strconv.Itoa(v), requestBtns(req), "%s", requestCard(req)); err != nil {
+				logger.Printf("send request %d to %d: %v", req.ID, v, err)
+			}
+		}
+		server.Sendf(chatid, "Your request has been sent to admins, you will be notified once it's handled.")
+	})
+
+	if !enabled {
+		return
+	}
+
+	server.RegisterInlineButton("a/user/requests", withPermission(nessielight.PermRequestReview), func(cq *tbot.CallbackQuery) error {
+		reqs, err := approver.PendingRequests()
+		if err != nil {
+			return err
+		}
+		server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{
+			{{Text: "Go Back", CallbackData: "a/user"}},
+		}, "<b>Pending Requests</b>: %d", len(reqs))
+		for _, req := range reqs {
+			server.SendfWithBtn(cq.Message.Chat.ID, requestBtns(req), "%s", requestCard(req))
+		}
+		return nil
+	})
+
+	server.RegisterInlineButtonPrefix("a/request/approve/", withPermission(nessielight.PermRequestReview), func(cq *tbot.CallbackQuery) error {
+		id, err := requestID(cq, "a/request/approve/")
+		if err != nil {
+			return err
+		}
+		user, req, err := approver.Approve(id, cq.From.ID)
+		if user == nil {
+			return err
+		}
+		msg := fmt.Sprintf("%s\n<b>Approved</b> by <code>%d</code>", requestCard(req), cq.From.ID)
+		if err != nil {
+			msg += fmt.Sprintf("\nprovision failed: %s", html.EscapeString(err.Error()))
+		}
+		server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{}, "%s", msg)
+		if err != nil {
+			return nil
+		}
+		chatid := strconv.Itoa(req.TelegramID)
+		server.Sendf(chatid, "Your registration request is approved. Send /proxy for proxy control.")
+		return sendUserProxies(server, chatid, user)
+	})
+
+	server.RegisterInlineButtonPrefix("a/request/reject/", withPermission(nessielight.PermRequestReview), func(cq *tbot.CallbackQuery) error {
+		id, err := requestID(cq, "a/request/reject/")
+		if err != nil {
+			return err
+		}
+		req, err := approver.Reject(id, cq.From.ID)
+		if err != nil {
+			return err
+		}
+		server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{}, "%s\n<b>Rejected</b> by <code>%d</code>",
+			requestCard(req), cq.From.ID)
+		server.Sendf(strconv.Itoa(req.TelegramID), "Your registration request is rejected.")
+		return nil
+	})
+}
+
+// request id in callback data
+func requestID(cq *tbot.CallbackQuery, prefix string) (uint, error) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(cq.Data, prefix), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid request %s", cq.Data)
+	}
+	return uint(id), nil
+}
+
+func requestBtns(req nessielight.RegisterRequest) [][]tbot.InlineKeyboardButton {
+	return [][]tbot.InlineKeyboardButton{{
+		{Text: "Approve", CallbackData: fmt.Sprintf("a/request/approve/%d", req.ID)},
+		{Text: "Reject", CallbackData: fmt.Sprintf("a/request/reject/%d", req.ID)},
+	}}
+}
+
+// request with telegram profile of the requester
+func requestCard(req nessielight.RegisterRequest) string {
+	name := req.Name
+	if name == "" {
+		name = strconv.Itoa(req.TelegramID)
+	}
+	msg := fmt.Sprintf("<b>Registration Request</b> #%d\nfrom: <a href=\"tg://user?id=%d\">%s</a>",
+		req.ID, req.TelegramID, html.EscapeString(name))
+	if req.Username != "" {
+		msg += " @" + html.EscapeString(req.Username)
+	}
+	msg += fmt.Sprintf("\nID: <code>%d</code>\ntime: %s", req.TelegramID, req.CreatedAt.Format("2006-01-02 15:04"))
+	if req.Note != "" {
+		msg += "\nnote: " + html.EscapeString(req.Note)
+	}
+	return msg
+}
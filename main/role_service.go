@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/Project-Nessie/nessielight"
+	"github.com/Project-Nessie/nessielight/tgolf"
+	"github.com/yanzay/tbot/v2"
+)
+
+func registerRoleService(server *tgolf.Server) {
+	roleNames := make([]string, len(nessielight.Roles))
+	for i, v := range nessielight.Roles {
+		roleNames[i] = string(v)
+	}
+
+	server.RegisterInlineButton("a/role", withPermission(nessielight.PermRoleManage), func(cq *tbot.CallbackQuery) error {
+		assignments, err := nessielight.RoleAssignments()
+		if err != nil {
+			return err
+		}
+		msg := "<b>Roles</b>\n"
+		for _, v := range assignments {
+			msg += fmt.Sprintf("<code>%d</code> <b>%s</b>, granted by <code>%d</code>\n", v.TelegramID, v.Role, v.GrantedBy)
+		}
+		msg += "\n"
+		for _, role := range nessielight.Roles {
+			perms := make([]string, 0, len(role.Permissions()))
+			for _, v := range role.Permissions() {
+				perms = append(perms, string(v))
+			}
+			if len(perms) == 0 {
+				perms = append(perms, "none")
+			}
+			msg += fmt.Sprintf("%s: %s\n", role, strings.Join(perms, ", "))
+		}
+		server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{
+			{{Text: "Set Role", CallbackData: "a/role/set"}},
+			{{Text: "Go Back", CallbackData: "a/back"}},
+		}, "%s", truncate(msg, 3500))
+		return nil
+	})
+
+	server.Register(">>>role/set", "", withPermission(nessielight.PermRoleManage), []tgolf.Parameter{
+		tgolf.NewParam("id", "telegram user id", func(value string) bool {
+			_, err := strconv.Atoi(value)
+			return err == nil
+		}),
+		tgolf.NewParam("role", fmt.Sprintf("role: %s (<code>user</code> revokes granted role)",
+			strings.Join(roleNames, ", ")), func(value string) bool {
+			return nessielight.Role(value).Valid()
+		}),
+	}, func(argv []tgolf.Argument, from *tbot.User, chatid string) {
+		id, _ := strconv.Atoi(argv[0].Value)
+		role := nessielight.Role(argv[1].Value)
+		if err := nessielight.SetRole(id, role, from.ID); err != nil {
+			server.Sendf(chatid, "set role failed: %s", html.EscapeString(err.Error()))
+			return
+		}
+		server.Sendf(chatid, "done. role of <code>%d</code> is <b>%s</b>", id, role)
+		if id != from.ID {
+			server.Sendf(strconv.Itoa(id), "Your role is set to <b>%s</b> by <code>%d</code>", role, from.ID)
+		}
+	})
+	server.RegisterInlineButton("a/role/set", withPermission(nessielight.PermRoleManage), func(cq *tbot.CallbackQuery) error {
+		server.EditCallbackBtn(cq, [][]tbot.InlineKeyboardButton{})
+		return server.StartCommand(">>>role/set", cq.From, cq.Message.Chat)
+	})
+}
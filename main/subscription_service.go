@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Project-Nessie/nessielight"
+	"github.com/Project-Nessie/nessielight/tgolf"
+	"github.com/yanzay/tbot/v2"
+)
+
+// path prefix of subscription urls, followed by subscription token
+const subPath = "/sub/"
+
+// client config formats served by bot and subscription
+var clientConfigs = map[string]struct {
+	generate    func(nessielight.User) (string, error)
+	filename    string
+	contentType string
+	caption     string
+}{
+	"clash": {nessielight.ClashConfig, "nessielight.yaml", "text/yaml; charset=utf-8",
+		"Clash profile, vless proxies are left out"},
+	"clashmeta": {nessielight.ClashMetaConfig, "nessielight.yaml", "text/yaml; charset=utf-8",
+		"Clash.Meta profile"},
+	"singbox": {nessielight.SingBoxConfig, "config.json", "application/json",
+		"sing-box config, socks on 127.0.0.1:1080 and http on 127.0.0.1:1081"},
+	"v2ray": {nessielight.V2rayClientConfig, "config.json", "application/json",
+		"v2ray client config, socks on 127.0.0.1:1080 and http on 127.0.0.1:1081"},
+}
+
+// subscription url of a token
+func subscriptionUrl(token string) string {
+	base := subUrl
+	if base == "" {
+		base = "http://" + subListen
+	}
+	return strings.TrimSuffix(base, "/") + subPath + token
+}
+
+// serve share links of the user owning the token in the url
+func handleSubscription(w http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.URL.Path, subPath)
+	user, err := nessielight.UserManagerInstance.FindUserBySubscriptionToken(token)
+	if err != nil {
+		logger.Print("subscription: ", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.NotFound(w, req)
+		return
+	}
+	if user.Suspension() != "" {
+		http.Error(w, "account is suspended", http.StatusForbidden)
+		return
+	}
+	logger.Printf("subscription of user %d from %s", user.TelegramID(), req.RemoteAddr)
+	w.Header().Set("Subscription-Userinfo", nessielight.SubscriptionUserinfo(user))
+	w.Header().Set("Profile-Update-Interval", "24")
+	switch format := req.URL.Query().Get("format"); format {
+	case "":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, nessielight.SubscriptionLinks(user))
+	case "clash", "clashmeta", "singbox", "v2ray":
+		config, err := clientConfigs[format].generate(user)
+		if err != nil {
+			logger.Print("subscription: ", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", clientConfigs[format].contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, clientConfigs[format].filename))
+		fmt.Fprint(w, config)
+	default:
+		http.Error(w, "unknown format "+format, http.StatusBadRequest)
+	}
+}
+
+// run subscription server on subListen
+func startSubscriptionServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc(subPath, handleSubscription)
+	go func() {
+		logger.Printf("subscription server listening on %s", subListen)
+		if err := http.ListenAndServe(subListen, mux); err != nil {
+			logger.Print("subscription server: ", err)
+		}
+	}()
+}
+
+func registerSubscriptionService(server *tgolf.Server) {
+	subBtns := [][]tbot.InlineKeyboardButton{
+		{{Text: "Reset URL", CallbackData: "p/sub/reset"}},
+		{{Text: "Go Back", CallbackData: "p/back"}},
+	}
+	subHelp := "Import this url in v2rayN, Shadowrocket or other clients, which update proxies automatically. " +
+		"Reset it if it is leaked."
+
+	server.RegisterInlineButton("p/sub", withAuth, func(cq *tbot.CallbackQuery) error {
+		if subListen == "" {
+			server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{}, "<i>subscription is not enabled</i>")
+			return nil
+		}
+		user, err := GetUserByTid(cq.From.ID)
+		if err != nil {
+			return err
+		}
+		token, err := nessielight.UserSubscriptionToken(user)
+		if err != nil {
+			return err
+		}
+		server.EditCallbackMsgWithBtn(cq, subBtns, "<b>Subscription</b>\n<code>%s</code>\n"+
+			"append <code>?format=clash</code>, <code>?format=clashmeta</code>, <code>?format=singbox</code> or <code>?format=v2ray</code> for client configs\n%s",
+			subscriptionUrl(token), subHelp)
+		return nil
+	})
+	server.RegisterInlineButton("p/sub/reset", withAuth, func(cq *tbot.CallbackQuery) error {
+		if subListen == "" {
+			server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{}, "<i>subscription is not enabled</i>")
+			return nil
+		}
+		user, err := GetUserByTid(cq.From.ID)
+		if err != nil {
+			return err
+		}
+		token, err := nessielight.ResetSubscriptionToken(user)
+		if err != nil {
+			return err
+		}
+		server.EditCallbackMsgWithBtn(cq, subBtns, "<b>Subscription</b>\n<code>%s</code>\nThe old url is invalid now.", subscriptionUrl(token))
+		return nil
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Project-Nessie/nessielight"
+)
+
+func TestHandleSubscription(t *testing.T) {
+	initTestV2ray(t)
+	proxy, err := nessielight.NewProxyOf("vless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := nessielight.UserManagerInstance.NewUser(1001)
+	if err := user.SetProxy([]nessielight.Proxy{proxy}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nessielight.UserManagerInstance.SetUser(user); err != nil {
+		t.Fatal(err)
+	}
+	token, err := nessielight.UserSubscriptionToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url         string
+		code        int
+		contentType string
+		body        string
+	}{
+		{subPath + token, http.StatusOK, "text/plain; charset=utf-8", ""},
+		{subPath + token + "?format=clash", http.StatusOK, "text/yaml; charset=utf-8", "proxies: [\"DIRECT\"]"},
+		{subPath + token + "?format=clashmeta", http.StatusOK, "text/yaml; charset=utf-8", "\"type\":\"vless\""},
+		{subPath + token + "?format=singbox", http.StatusOK, "application/json", "\"type\": \"vless\""},
+		{subPath + token + "?format=v2ray", http.StatusOK, "application/json", "\"protocol\": \"vless\""},
+		{subPath + token + "?format=surge", http.StatusBadRequest, "", "unknown format surge"},
+		{subPath + "unknown", http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handleSubscription(w, httptest.NewRequest("GET", tt.url, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: code %d, want %d", tt.url, w.Code, tt.code)
+			continue
+		}
+		if tt.contentType != "" && w.Header().Get("Content-Type") != tt.contentType {
+			t.Errorf("%s: content type %s, want %s", tt.url, w.Header().Get("Content-Type"), tt.contentType)
+		}
+		if tt.code == http.StatusOK && !strings.HasPrefix(w.Header().Get("Subscription-Userinfo"), "upload=0; download=0;") {
+			t.Errorf("%s: userinfo %s", tt.url, w.Header().Get("Subscription-Userinfo"))
+		}
+		if !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%s: body %s, want %s", tt.url, w.Body.String(), tt.body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handleSubscription(w, httptest.NewRequest("GET", subPath+token, nil))
+	links, err := base64.StdEncoding.DecodeString(w.Body.String())
+	if err != nil || string(links) != proxy.Link() {
+		t.Errorf("links %q, want %s", links, proxy.Link())
+	}
+
+	if err := user.SetSuspension("expired"); err != nil {
+		t.Fatal(err)
+	}
+	if err := nessielight.UserManagerInstance.SetUser(user); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handleSubscription(w, httptest.NewRequest("GET", subPath+token, nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("suspended user: code %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"time"
+
+	"github.com/Project-Nessie/nessielight"
+	"github.com/Project-Nessie/nessielight/tgolf"
+	"github.com/yanzay/tbot/v2"
+)
+
+func registerTokenService(server *tgolf.Server) {
+	server.Register(">>>token/new", "", withPermission(nessielight.PermUserAdd), []tgolf.Parameter{
+		tgolf.NewParam("uses", "max uses, <code>0</code> for unlimited", func(value string) bool {
+			uses, err := strconv.Atoi(value)
+			return err == nil && uses >= 0
+		}),
+		tgolf.NewParam("valid", "validity like <code>72h</code> or <code>7d</code>, <code>0</code> for never expire", func(value string) bool {
+			d, err := parseDuration(value)
+			return err == nil && d >= 0
+		}),
+		tgolf.NewParam("quota", "quota of registered users, e.g. <code>total=100GB</code> or <code>0</code> for unlimited", func(value string) bool {
+			_, err := nessielight.ParseTrafficQuota(value)
+			return err == nil
+		}),
+		tgolf.NewParam("expiry", "validity of registered users like <code>30d</code>, <code>0</code> for never expire", func(value string) bool {
+			d, err := parseDuration(value)
+			return err == nil && d >= 0
+		}),
+		tgolf.NewParam("group", "group of registered users, <code>-</code> for none", nil),
+	}, func(argv []tgolf.Argument, from *tbot.User, chatid string) {
+		uses, _ := strconv.Atoi(argv[0].Value)
+		valid, _ := parseDuration(argv[1].Value)
+		quota, _ := nessielight.ParseTrafficQuota(argv[2].Value)
+		validity, _ := parseDuration(argv[3].Value)
+		group := argv[4].Value
+		if group == "-" {
+			group = ""
+		}
+		opt := nessielight.TokenOptions{
+			Creator: from.ID,
+			MaxUses: uses,
+			Preset:  nessielight.UserPreset{Quota: quota, Validity: validity, Group: group},
+		}
+		if valid > 0 {
+			opt.ExpiresAt = time.Now().Add(valid)
+		}
+		token, err := nessielight.AuthServiceInstance.GenToken(opt)
+		if err != nil {
+			server.Sendf(chatid, "generate token failed: %s", html.EscapeString(err.Error()))
+			return
+		}
+		server.Sendf(chatid, "token: <code>%s</code>%s\n%s", token.Token, tokenLinkText(token), tokenText(token))
+	})
+	server.RegisterInlineButton("a/user/token", withPermission(nessielight.PermUserAdd), func(cq *tbot.CallbackQuery) error {
+		server.EditCallbackBtn(cq, [][]tbot.InlineKeyboardButton{})
+		return server.StartCommand(">>>token/new", cq.From, cq.Message.Chat)
+	})
+
+	server.RegisterInlineButton("a/user/tokens", withPermission(nessielight.PermUserAdd), func(cq *tbot.CallbackQuery) error {
+		tokens, err := nessielight.AuthServiceInstance.Tokens()
+		if err != nil {
+			return err
+		}
+		msg := "<b>Outstanding Tokens</b>\n"
+		for _, v := range tokens {
+			msg += fmt.Sprintf("<code>%s</code>%s\n%s\n", v.Token, tokenLinkText(v), tokenText(v))
+		}
+		if len(tokens) == 0 {
+			msg += "<i>no tokens</i>\n"
+		}
+		server.EditCallbackMsgWithBtn(cq, [][]tbot.InlineKeyboardButton{
+			{{Text: "Revoke Token", CallbackData: "a/user/tokens/revoke"}},
+			{{Text: "Go Back", CallbackData: "a/user"}},
+		}, "%s", truncate(msg, 3500))
+		return nil
+	})
+
+	server.Register(">>>token/revoke", "", withPermission(nessielight.PermUserAdd), []tgolf.Parameter{
+		tgolf.NewParam("token", "token to revoke", nil),
+	}, func(argv []tgolf.Argument, from *tbot.User, chatid string) {
+		if err := nessielight.AuthServiceInstance.RevokeToken(argv[0].Value); err != nil {
+			server.Sendf(chatid, "revoke failed: %s", html.EscapeString(err.Error()))
+			return
+		}
+		server.Sendf(chatid, "done.")
+	})
+	server.RegisterInlineButton("a/user/tokens/revoke", withPermission(nessielight.PermUserAdd), func(cq *tbot.CallbackQuery) error {
+		server.EditCallbackBtn(cq, [][]tbot.InlineKeyboardButton{})
+		return server.StartCommand(">>>token/revoke", cq.From, cq.Message.Chat)
+	})
+}
+
+// describe options and usage of a token
+func tokenText(token nessielight.RegisterToken) string {
+	uses := "unlimited"
+	if token.MaxUses > 0 {
+		uses = strconv.Itoa(token.MaxUses)
+	}
+	msg := fmt.Sprintf("by <code>%d</code>, used %d/%s, expires <b>%s</b>, quota <b>%v</b>",
+		token.Creator, token.Uses, uses, expiryText(token.ExpiresAt), token.Preset.Quota)
+	if token.Preset.Validity > 0 {
+		msg += fmt.Sprintf(", users valid for <b>%v</b>", token.Preset.Validity)
+	}
+	if token.Preset.Group != "" {
+		msg += fmt.Sprintf(", group <b>%s</b>", html.EscapeString(token.Preset.Group))
+	}
+	return msg
+}
+
+// registration link of a token, prefixed with newline
+func tokenLinkText(token nessielight.RegisterToken) string {
+	link := token.Link()
+	if link == "" {
+		return ""
+	}
+	return fmt.Sprintf("\nlink: %s", html.EscapeString(link))
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Project-Nessie/nessielight"
+	"github.com/Project-Nessie/nessielight/tgolf"
+	"github.com/yanzay/tbot/v2"
+)
+
+// user whose field an admin is entering, set by buttons of the editor
+var userEdits = struct {
+	sync.Mutex
+	m map[int]int
+}{m: make(map[int]int)}
+
+// callback data of the editor is userEditPrefix + "<tid>[/<action>[/<arg>]]"
+const userEditPrefix = "a/user/edit/"
+
+// max users listed as buttons by Set User
+const userEditListSize = 40
+
+// text field of a user edited by the editor
+type userField struct {
+	key  string
+	desc string
+	// check and apply value to user, the user is saved afterwards
+	set func(user nessielight.User, value string) error
+}
+
+var userFields = []userField{
+	{"name", "name", func(user nessielight.User, value string) error {
+		return user.SetName(value)
+	}},
+	{"quota", "quota, e.g. <code>total=100GB</code> or <code>0</code> for unlimited", func(user nessielight.User, value string) error {
+		quota, err := nessielight.ParseTrafficQuota(value)
+		if err != nil {
+			return err
+		}
+		return user.SetQuota(quota)
+	}},
+	{"expiry", "expiry, a date like <code>2006-01-02</code>, a duration from now like <code>30d</code>, or <code>0</code> for never", func(user nessielight.User, value string) error {
+		t, err := parseExpiry(value, time.Now())
+		if err != nil {
+			return err
+		}
+		return user.SetExpiry(t)
+	}},
+	{"group", "group, <code>-</code> for none", func(user nessielight.User, value string) error {
+		if value == "-" {
+			value = ""
+		}
+		return user.SetGroup(value)
+	}},
+	{"notes", "notes, <code>-</code> for none", func(user nessielight.User, value string) error {
+		if value == "-" {
+			value = ""
+		}
+		return user.SetNotes(value)
+	}},
+}
+
+func registerUserEditor(server *tgolf.Server) {
+	server.RegisterInlineButton("a/user/set", withPermission(nessielight.PermUserEdit), func(cq *tbot.CallbackQuery) error {
+		users, err := nessielight.UserManagerInstance.All()
+		if err != nil {
+			return err
+		}
+		var btns [][]tbot.InlineKeyboardButton
+		for i, v := range users {
+			if i == userEditListSize {
+				break
+			}
+			btn := tbot.InlineKeyboardButton{
+				Text:         userLabel(v),
+				CallbackData: fmt.Sprintf("%s%d", userEditPrefix, v.TelegramID()),
+			}
+			if i%2 == 0 {
+				btns = append(btns, []tbot.InlineKeyboardButton{btn})
+			} else {
+				btns[len(btns)-1] = append(btns[len(btns)-1], btn)
+			}
+		}
+		btns = append(btns,
+			[]tbot.InlineKeyboardButton{{Text: "Enter Telegram ID", CallbackData: "a/user/set/id"}},
+			[]tbot.InlineKeyboardButton{{Text: "Go Back", CallbackData: "a/user"}},
+		)
+		msg := fmt.Sprintf("<b>Set User</b>\npick one of %d users", len(users))
+		if len(users) > userEditListSize {
+			msg += fmt.Sprintf(", only the first %d are listed", userEditListSize)
+		}
+		server.EditCallbackMsgWithBtn(cq, btns, "%s", msg)
+		return nil
+	})
+
+	server.Register(">>>user/edit", "", withPermission(nessielight.PermUserEdit), []tgolf.Parameter{
+		tgolf.NewParam("id", "user id", func(value string) bool {
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				return false
+			}
+			user, err := GetUserByTid(id)
+			return err == nil && user != nil
+		}),
+	}, func(argv []tgolf.Argument, from *tbot.User, chatid string) {
+		id, _ := strconv.Atoi(argv[0].Value)
+		user, err := GetUserByTid(id)
+		if err != nil || user == nil {
+			server.Sendf(chatid, "user not found")
+			return
+		}
+		server.SendfWithBtn(chatid, userEditBtns(user), "%s", userEditText(user))
+	})
+	server.RegisterInlineButton("a/user/set/id", withPermission(nessielight.PermUserEdit), func(cq *tbot.CallbackQuery) error {
+		server.EditCallbackBtn(cq, [][]tbot.InlineKeyboardButton{})
+		return server.StartCommand(">>>user/edit", cq.From, cq.Message.Chat)
+	})
+
+	for _, field := range userFields {
+		field := field
+		server.Register(">>>user/edit/"+field.key, "", withPermission(nessielight.PermUserEdit), []tgolf.Parameter{
+			tgolf.NewParam("value", field.desc, nil),
+		}, func(argv []tgolf.Argument, from *tbot.User, chatid string) {
+			userEdits.Lock()
+			tid, ok := userEdits.m[from.ID]
+			delete(userEdits.m, from.ID)
+			userEdits.Unlock()
+			if !ok {
+				server.Sendf(chatid, "no user is being edited")
+				return
+			}
+			user, err := GetUserByTid(tid)
+			if err != nil || user == nil {
+				server.Sendf(chatid, "user not found")
+				return
+			}
+			if err := field.set(user, argv[0].Value); err != nil {
+				server.Sendf(chatid, "set %s failed: %s", field.key, html.EscapeString(err.Error()))
+				return
+			}
+			if err := nessielight.UserManagerInstance.SetUser(user); err != nil {
+				server.Sendf(chatid, "set %s failed: %s", field.key, html.EscapeString(err.Error()))
+				return
+			}
+			switch field.key {
+			case "quota":
+				if err := nessielight.EnforceQuota(user); err != nil {
+					server.Sendf(chatid, "enforce quota failed: %s", html.EscapeString(err.Error()))
+				}
+			case "expiry":
+				if err := nessielight.EnforceExpiry(user, time.Now()); err != nil {
+					server.Sendf(chatid, "enforce expiry failed: %s", html.EscapeString(err.Error()))
+				}
+			}
+			logger.Printf("admin %d sets %s of user %d", from.ID, field.key, tid)
+			server.SendfWithBtn(chatid, userEditBtns(user), "%s", userEditText(user))
+		})
+	}
+
+	server.RegisterInlineButtonPrefix(userEditPrefix, withPermission(nessielight.PermUserEdit), func(cq *tbot.CallbackQuery) error {
+		items := strings.SplitN(strings.TrimPrefix(cq.Data, userEditPrefix), "/", 3)
+		tid, err := strconv.Atoi(items[0])
+		if err != nil {
+			return fmt.Errorf("invalid user %s", items[0])
+		}
+		user, err := GetUserByTid(tid)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("user %d not found", tid)
+		}
+		action, arg := "", ""
+		// notification of changed proxy
+		var data nessielight.NotifyData
+		if len(items) > 1 {
+			action = items[1]
+		}
+		if len(items) > 2 {
+			arg = items[2]
+		}
+
+		switch action {
+		case "":
+			server.EditCallbackMsgWithBtn(cq, userEditBtns(user), "%s", userEditText(user))
+			return nil
+		case "proxies":
+			server.EditCallbackMsgWithBtn(cq, userProxyBtns(user), "%s", userEditText(user))
+			return nil
+		case "add":
+			proxy, err := nessielight.AddUserProxy(user, arg)
+			if err != nil {
+				return err
+			}
+			data = nessielight.NotifyData{Proxy: fmt.Sprintf("%s:%d", arg, proxy.ProxyID()), Action: "added"}
+		case "rm", "rot":
+			name, id, err := parseProxyRef(arg)
+			if err != nil {
+				return err
+			}
+			if action == "rm" {
+				err = nessielight.RemoveUserProxy(user, name, id)
+				data = nessielight.NotifyData{Proxy: arg, Action: "removed"}
+			} else {
+				_, err = nessielight.RotateUserProxy(user, name, id)
+				data = nessielight.NotifyData{Proxy: arg, Action: "rotated"}
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			for _, field := range userFields {
+				if field.key == action {
+					userEdits.Lock()
+					userEdits.m[cq.From.ID] = tid
+					userEdits.Unlock()
+					server.EditCallbackBtn(cq, [][]tbot.InlineKeyboardButton{})
+					return server.StartCommand(">>>user/edit/"+field.key, cq.From, cq.Message.Chat)
+				}
+			}
+			return fmt.Errorf("unknown action %s", action)
+		}
+		// proxies are changed
+		logger.Printf("admin %d changes proxies of user %d: %s %s", cq.From.ID, tid, action, arg)
+		server.EditCallbackMsgWithBtn(cq, userProxyBtns(user), "%s", userEditText(user))
+		// the change is applied, so failed notifications are only logged
+		nessielight.Notify(user, nessielight.EventProxyChanged, data)
+		return nil
+	})
+}
+
+// name of user in buttons
+func userLabel(user nessielight.User) string {
+	if user.Name() == "" {
+		return strconv.Itoa(user.TelegramID())
+	}
+	return fmt.Sprintf("%s (%d)", user.Name(), user.TelegramID())
+}
+
+// "type:id" in callback data
+func parseProxyRef(text string) (string, uint, error) {
+	sep := strings.LastIndexByte(text, ':')
+	if sep < 0 {
+		return "", 0, fmt.Errorf("invalid proxy %s", text)
+	}
+	id, err := strconv.ParseUint(text[sep+1:], 10, 32)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid proxy %s", text)
+	}
+	return text[:sep], uint(id), nil
+}
+
+func userEditText(user nessielight.User) string {
+	traffic := user.Traffic()
+	suspension := user.Suspension()
+	if suspension == "" {
+		suspension = "no"
+	}
+	group := user.Group()
+	if group == "" {
+		group = "none"
+	}
+	msg := fmt.Sprintf("<b>Edit User</b> <code>%d</code>\nname: <b>%s</b>\ngroup: <b>%s</b>\n"+
+		"quota: <b>%v</b>, used down <b>%v</b> up <b>%v</b>\nexpiry: <b>%s</b>\nsuspended: <b>%s</b>\n",
+		user.TelegramID(), html.EscapeString(user.Name()), html.EscapeString(group),
+		user.Quota(), traffic.Downlink, traffic.Uplink, expiryText(user.Expiry()), suspension)
+	if user.Notes() != "" {
+		msg += fmt.Sprintf("notes: %s\n", html.EscapeString(user.Notes()))
+	}
+	msg += "proxies:"
+	proxies := user.Proxy()
+	for _, v := range proxies {
+		msg += fmt.Sprintf(" <code>%s:%d</code>", v.ProxyType(), v.ProxyID())
+	}
+	if len(proxies) == 0 {
+		msg += " <i>none</i>"
+	}
+	return msg
+}
+
+func userEditBtns(user nessielight.User) [][]tbot.InlineKeyboardButton {
+	prefix := fmt.Sprintf("%s%d/", userEditPrefix, user.TelegramID())
+	return [][]tbot.InlineKeyboardButton{
+		{{Text: "Name", CallbackData: prefix + "name"}, {Text: "Group", CallbackData: prefix + "group"}},
+		{{Text: "Quota", CallbackData: prefix + "quota"}, {Text: "Expiry", CallbackData: prefix + "expiry"}},
+		{{Text: "Notes", CallbackData: prefix + "notes"}, {Text: "Proxies", CallbackData: prefix + "proxies"}},
+		{{Text: "Go Back", CallbackData: "a/user/set"}},
+	}
+}
+
+// remove or rotate each proxy, or add a proxy of any type
+func userProxyBtns(user nessielight.User) [][]tbot.InlineKeyboardButton {
+	prefix := fmt.Sprintf("%s%d/", userEditPrefix, user.TelegramID())
+	var btns [][]tbot.InlineKeyboardButton
+	for _, v := range user.Proxy() {
+		ref := fmt.Sprintf("%s:%d", v.ProxyType(), v.ProxyID())
+		btns = append(btns, []tbot.InlineKeyboardButton{
+			{Text: "Rotate " + ref, CallbackData: prefix + "rot/" + ref},
+			{Text: "Remove " + ref, CallbackData: prefix + "rm/" + ref},
+		})
+	}
+	var add []tbot.InlineKeyboardButton
+	for _, name := range nessielight.EnabledProxyTypes() {
+		add = append(add, tbot.InlineKeyboardButton{Text: "Add " + name, CallbackData: prefix + "add/" + name})
+	}
+	btns = append(btns, add, []tbot.InlineKeyboardButton{{Text: "Go Back", CallbackData: strings.TrimSuffix(prefix, "/")}})
+	return btns
+}
@@ -5,7 +5,6 @@ import (
 	"log"
 	"os"
 	"regexp"
-	"strconv"
 
 	"github.com/Project-Nessie/nessielight/utils"
 	"gorm.io/driver/sqlite"
@@ -18,20 +17,32 @@ var logger *log.Logger
 var AuthServiceInstance TelegramAuthService
 var UserManagerInstance UserManager
 var V2rayServiceInstance V2rayService
+
+// nil if v2ray is not controlled by nessielight
+var SystemCtlServiceInstance SystemCtlService
 var DataBase *GormDB
 
 func InitDBwithFile(path string) error {
-	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	// wait for locks instead of failing, since bot updates are handled concurrently
+	db, err := gorm.Open(sqlite.Open(path+"?_busy_timeout=5000"), &gorm.Config{})
 	if err != nil {
 		return err
 	}
 	DataBase = db
-	if err := DataBase.AutoMigrate(&v2rayProxy{}); err != nil {
-		return err
+	for _, name := range proxyTypeNames {
+		if err := DataBase.AutoMigrate(proxyTypes[name].Model); err != nil {
+			return err
+		}
 	}
 	if err := DataBase.AutoMigrate(&simpleUser{}); err != nil {
 		return err
 	}
+	if err := migrateLegacyProxyColumns(); err != nil {
+		return err
+	}
+	if err := DataBase.AutoMigrate(&trafficRecord{}, &trafficCycle{}, &registerToken{}, &registerRequest{}, &roleAssignment{}, &trafficJournal{}); err != nil {
+		return err
+	}
 	var proxies []v2rayProxy
 	DataBase.Find(&proxies)
 	for _, v := range proxies {
@@ -40,18 +51,17 @@ func InitDBwithFile(path string) error {
 	var users []simpleUser
 	DataBase.Find(&users)
 	for _, v := range users {
-		logger.Print("user id=", v.ID, " tid=", v.Registerid, " proxy:", v.V2rayProxyID)
+		logger.Print("user id=", v.ID, " tid=", v.Registerid, " proxy:", v.Proxies)
 	}
 	return nil
 }
 
-func InitV2rayService(inboundTag string, vmessPort, vmessClientPort int, vmessAddress, wsPath, v2rayApi string) error {
+func InitV2rayService(inboundTag string, vmess InboundOptions, vmessClientPort int, vmessAddress, v2rayApi string) error {
 	client := v2rayClient{
 		inboundTag: inboundTag,
-		port:       vmessPort,
+		vmess:      vmess,
 		clientport: vmessClientPort,
 		domain:     vmessAddress,
-		path:       wsPath,
 	}
 	V2rayServiceInstance = &client
 
@@ -59,17 +69,62 @@ func InitV2rayService(inboundTag string, vmessPort, vmessClientPort int, vmessAd
 		return err
 	}
 	V2rayServiceInstance.RemoveInbound(inboundTag)
-	if err := V2rayServiceInstance.AddVmessWsInbound(inboundTag, uint16(vmessPort), wsPath); err != nil {
+	if err := V2rayServiceInstance.AddVmessInbound(inboundTag, vmess); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// add a vless inbound beside the vmess one. Must be called after InitV2rayService
+func InitVlessInbound(vlessTag string, vless InboundOptions) error {
+	client := V2rayServiceInstance.(*v2rayClient)
+	client.vlessTag = vlessTag
+	client.vless = vless
+
+	V2rayServiceInstance.RemoveInbound(vlessTag)
+	if err := V2rayServiceInstance.AddVlessInbound(vlessTag, vless); err != nil {
+		return err
+	}
+	return nil
+}
+
+// add a trojan inbound beside the vmess one. Must be called after InitV2rayService
+func InitTrojanInbound(trojanTag string, trojan InboundOptions) error {
+	client := V2rayServiceInstance.(*v2rayClient)
+	client.trojanTag = trojanTag
+	client.trojan = trojan
+
+	V2rayServiceInstance.RemoveInbound(trojanTag)
+	if err := V2rayServiceInstance.AddTrojanInbound(trojanTag, trojan); err != nil {
+		return err
+	}
+	return nil
+}
+
+// enable shadowsocks proxies. Inbounds are added by Activate of each proxy,
+// using ports in [portMin, portMax]. plugin is appended to ss links if not empty.
+// Must be called after InitV2rayService
+func InitShadowsocks(ssTag, listen string, portMin, portMax int, cipher, plugin string) error {
+	if _, ok := ssCiphers[cipher]; !ok {
+		return fmt.Errorf("unknown shadowsocks cipher %s", cipher)
+	}
+	if portMin <= 0 || portMax > 65535 || portMin > portMax {
+		return fmt.Errorf("invalid shadowsocks port range %d-%d", portMin, portMax)
+	}
+	client := V2rayServiceInstance.(*v2rayClient)
+	client.ssTag = ssTag
+	client.ssListen = listen
+	client.ssPortMin = uint16(portMin)
+	client.ssPortMax = uint16(portMax)
+	client.ssCipher = cipher
+	client.ssPlugin = plugin
+	return nil
+}
+
 func init() {
 	AuthServiceInstance = &simpleTelegramAuthService{
 		userManager: &UserManagerInstance,
-		tokenDB:     make(map[string]bool),
 	}
 	UserManagerInstance = &simpleUserManager{}
 }
@@ -82,7 +137,11 @@ func GetUserProxyMessage(user User) string {
 	return msg
 }
 
+// activate proxies of a user, or return ErrUserSuspended for suspended users
 func ApplyUserProxy(user User) error {
+	if user.Suspension() != "" {
+		return ErrUserSuspended
+	}
 	for _, proxy := range user.Proxy() {
 		if err := proxy.Activate(); err != nil {
 			return fmt.Errorf("ApplyUserProxy(id=%d): %s", user.TelegramID(), err.Error())
@@ -141,42 +200,6 @@ type NamedTraffic struct {
 	Name string
 }
 
-func V2rayUpdateUserTraffic() error {
-	stats, err := V2rayServiceInstance.QueryUserTraffic(true) // !!! false just for debug
-	if err != nil {
-		return err
-	}
-	for _, v := range stats {
-		_, name, linktype := trafficNameMatch(v.Name)
-		id := name[len(V2rayServiceInstance.(*v2rayClient).inboundTag):]
-
-		uid, err := strconv.ParseInt(id, 10, 32)
-		if err != nil {
-			logger.Print("V2rayUpdateUserTraffic invalid email: ", name)
-			continue
-		}
-
-		logger.Print("V2rayUpdateUserTraffic ", name, " ", linktype, " ", utils.ByteValue(v.Value))
-		logger.Print("V2rayUpdateUserTraffic id=", id)
-		if user, err := UserManagerInstance.FindUserByProxy(uint(uid)); err == nil && user != nil {
-			data := user.Traffic()
-			if linktype == "downlink" {
-				data.Downlink += utils.ByteValue(v.Value)
-			} else if linktype == "uplink" {
-				data.Uplink += utils.ByteValue(v.Value)
-			}
-			if err := user.SetTraffic(data); err != nil {
-				return err
-			}
-			if err := UserManagerInstance.SetUser(user); err != nil {
-				return err
-			}
-			logger.Print("V2rayUpdateUserTraffic user:", user.Traffic())
-		}
-	}
-	return nil
-}
-
 func init() {
 	logger = log.New(os.Stderr, "[nessielight] ", log.LstdFlags|log.Lmsgprefix)
 }
@@ -187,6 +210,9 @@ func Restore() error {
 		return err
 	}
 	for _, v := range users {
+		if v.Suspension() != "" {
+			continue
+		}
 		for _, p := range v.Proxy() {
 			p.Activate()
 		}
@@ -0,0 +1,340 @@
+package nessielight
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"strings"
+	"sync"
+	"time"
+)
+
+// category of notifications, which users can opt out of
+type NotifyCategory string
+
+const (
+	NotifyQuota      NotifyCategory = "quota"
+	NotifyExpiry     NotifyCategory = "expiry"
+	NotifyProxy      NotifyCategory = "proxy"
+	NotifySuspension NotifyCategory = "suspension"
+	// notifications about other users, sent to users with PermUserEdit
+	NotifyAdmin NotifyCategory = "admin"
+)
+
+var NotifyCategories = []NotifyCategory{NotifyQuota, NotifyExpiry, NotifyProxy, NotifySuspension, NotifyAdmin}
+
+// preference key of the category, NotifyOff if the user opts out
+func (r NotifyCategory) PrefKey() string {
+	return "notify_" + string(r)
+}
+
+// whether user receives notifications of the category
+func (r NotifyCategory) Enabled(user User) bool {
+	return user.Preference(r.PrefKey()) != NotifyOff
+}
+
+const NotifyOff = "off"
+
+// names of events in NotifyEvents
+const (
+	// traffic of the user reaches 80% of quota
+	EventQuotaWarning = "quota_warning"
+	// traffic of the user reaches quota
+	EventQuotaReached = "quota_reached"
+	// account of the user expires soon, NotifyData.Remaining is set
+	EventExpirySoon = "expiry_soon"
+	// a proxy of the user is changed by an admin, NotifyData.Proxy and
+	// NotifyData.Action are set
+	EventProxyChanged = "proxy_changed"
+	// the user is suspended, see User.Suspension for the reason
+	EventSuspended = "suspended"
+)
+
+// data of templates in NotifyEvents
+type NotifyData struct {
+	User User
+	// percent of quota used
+	Percent int
+	// remaining time before expiry, e.g. "in 2d 3h (2006-01-02 15:04)"
+	Remaining string
+	// proxy as "type:id", and added, removed or rotated
+	Proxy, Action string
+}
+
+// templates of an event in html/template syntax, executed with NotifyData.
+// An empty template disables the message
+type NotifyEvent struct {
+	Category NotifyCategory
+	// sent to the user
+	User string
+	// sent to users with PermUserEdit, who can opt out by NotifyAdmin
+	Admin string
+}
+
+// events which can be notified. Templates can be changed before NewNotifier
+var NotifyEvents = map[string]NotifyEvent{
+	EventQuotaWarning: {
+		Category: NotifyQuota,
+		User:     `Your traffic has used <b>{{.Percent}}%</b> of quota <b>{{.User.Quota}}</b>.`,
+	},
+	EventQuotaReached: {
+		Category: NotifyQuota,
+		User:     `Your traffic has reached quota <b>{{.User.Quota}}</b>.`,
+	},
+	EventExpirySoon: {
+		Category: NotifyExpiry,
+		User:     `Your account expires <b>{{.Remaining}}</b>. Please contact admin to extend it.`,
+	},
+	EventProxyChanged: {
+		Category: NotifyProxy,
+		User:     `Your proxy <code>{{.Proxy}}</code> is {{.Action}} by admin, please get configs from /proxy again.`,
+	},
+	EventSuspended: {
+		Category: NotifySuspension,
+		User: `Your account is suspended{{if eq .User.Suspension "quota"}} since traffic exceeds quota <b>{{.User.Quota}}</b>` +
+			`{{else if eq .User.Suspension "expiry"}} since it has expired{{end}}. Please contact admin.`,
+		Admin: `User <code>{{.User.TelegramID}}</code> {{.User.Name}} is suspended by {{.User.Suspension}}.`,
+	},
+}
+
+// send text to a telegram user
+type NotifySender func(tid int, text string) error
+
+var ErrNotifierStopped = errors.New("notifier is stopped")
+
+// error of a sender which is not retried, e.g. the user has blocked the bot
+type PermanentError struct {
+	Err error
+}
+
+func (r *PermanentError) Error() string {
+	return r.Err.Error()
+}
+
+func (r *PermanentError) Unwrap() error {
+	return r.Err
+}
+
+// delay before the first retry, doubled for each further retry
+const notifyRetryDelay = 2 * time.Second
+
+type notifyMessage struct {
+	tid  int
+	send func() error
+	// failed attempts
+	attempts int
+	done     func(err error)
+}
+
+func (r *notifyMessage) finish(err error) {
+	if r.done != nil {
+		r.done(err)
+	}
+}
+
+type notifyTemplates struct {
+	category    NotifyCategory
+	user, admin *template.Template
+}
+
+// sends messages to users in a queue, at most one per interval, and retries
+// failed ones
+type Notifier struct {
+	send      NotifySender
+	interval  time.Duration
+	retries   int
+	templates map[string]notifyTemplates
+	queue     chan *notifyMessage
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	started   bool
+}
+
+// parse NotifyEvents. Messages are sent at most one per interval, and failed
+// ones are retried up to retries times
+func NewNotifier(send NotifySender, interval time.Duration, retries int) (*Notifier, error) {
+	templates := make(map[string]notifyTemplates)
+	for name, event := range NotifyEvents {
+		t := notifyTemplates{category: event.Category}
+		var err error
+		if event.User != "" {
+			if t.user, err = template.New(name).Parse(event.User); err != nil {
+				return nil, fmt.Errorf("template of event %s: %s", name, err.Error())
+			}
+		}
+		if event.Admin != "" {
+			if t.admin, err = template.New(name + "/admin").Parse(event.Admin); err != nil {
+				return nil, fmt.Errorf("admin template of event %s: %s", name, err.Error())
+			}
+		}
+		templates[name] = t
+	}
+	return &Notifier{
+		send:      send,
+		interval:  interval,
+		retries:   retries,
+		templates: templates,
+		queue:     make(chan *notifyMessage, 1024),
+		stop:      make(chan struct{}),
+	}, nil
+}
+
+func (r *Notifier) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.started {
+		return
+	}
+	r.started = true
+	r.wg.Add(1)
+	go r.loop()
+}
+
+// stop sending and wait for the message being sent. Queued messages are
+// dropped with ErrNotifierStopped
+func (r *Notifier) Stop() {
+	r.mu.Lock()
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	for {
+		select {
+		case m := <-r.queue:
+			m.finish(ErrNotifierStopped)
+		default:
+			return
+		}
+	}
+}
+
+// queue text to tid regardless of preferences. done, if not nil, is called
+// with nil once delivered, or with the last error after all retries
+func (r *Notifier) Send(tid int, text string, done func(err error)) {
+	r.SendFunc(tid, func() error {
+		return r.send(tid, text)
+	}, done)
+}
+
+// like Send, but delivered by send, e.g. forwarding a message to tid
+func (r *Notifier) SendFunc(tid int, send func() error, done func(err error)) {
+	r.enqueue(&notifyMessage{tid: tid, send: send, done: done})
+}
+
+func (r *Notifier) enqueue(m *notifyMessage) {
+	select {
+	case <-r.stop:
+		m.finish(ErrNotifierStopped)
+		return
+	default:
+	}
+	select {
+	case r.queue <- m:
+	case <-r.stop:
+		m.finish(ErrNotifierStopped)
+	}
+}
+
+func (r *Notifier) loop() {
+	defer r.wg.Done()
+	var last time.Time
+	for {
+		select {
+		case <-r.stop:
+			return
+		case m := <-r.queue:
+			if wait := r.interval - time.Since(last); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-r.stop:
+					timer.Stop()
+					m.finish(ErrNotifierStopped)
+					return
+				case <-timer.C:
+				}
+			}
+			last = time.Now()
+			r.deliver(m)
+		}
+	}
+}
+
+func (r *Notifier) deliver(m *notifyMessage) {
+	err := m.send()
+	if err == nil {
+		m.finish(nil)
+		return
+	}
+	m.attempts++
+	var permanent *PermanentError
+	if m.attempts > r.retries || errors.As(err, &permanent) {
+		logger.Printf("notify %d failed after %d attempts: %s", m.tid, m.attempts, err.Error())
+		m.finish(err)
+		return
+	}
+	// retry later without blocking other messages
+	time.AfterFunc(notifyRetryDelay<<(m.attempts-1), func() {
+		r.enqueue(m)
+	})
+}
+
+// queue the message of event to user unless the user opts out of its
+// category, and to admins if the event has an admin template
+func (r *Notifier) Notify(user User, event string, data NotifyData) error {
+	t, ok := r.templates[event]
+	if !ok {
+		return fmt.Errorf("unknown event %s", event)
+	}
+	data.User = user
+	if t.user != nil && t.category.Enabled(user) {
+		text, err := execute(t.user, data)
+		if err != nil {
+			return err
+		}
+		r.Send(user.TelegramID(), text, nil)
+	}
+	if t.admin == nil {
+		return nil
+	}
+	text, err := execute(t.admin, data)
+	if err != nil {
+		return err
+	}
+	admins, err := UsersWithPermission(PermUserEdit)
+	if err != nil {
+		return err
+	}
+	for _, tid := range admins {
+		// admins without user records cannot opt out
+		if admin, err := UserManagerInstance.FindUserByTelegramID(tid); err == nil && admin != nil && !NotifyAdmin.Enabled(admin) {
+			continue
+		}
+		r.Send(tid, text, nil)
+	}
+	return nil
+}
+
+func execute(t *template.Template, data NotifyData) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("template %s: %s", t.Name(), err.Error())
+	}
+	return b.String(), nil
+}
+
+// nil if notifications are disabled
+var NotifierInstance *Notifier
+
+// notify by NotifierInstance if set, errors are logged
+func Notify(user User, event string, data NotifyData) {
+	if NotifierInstance == nil {
+		return
+	}
+	if err := NotifierInstance.Notify(user, event, data); err != nil {
+		logger.Printf("notify %s to user %d: %s", event, user.TelegramID(), err.Error())
+	}
+}
@@ -0,0 +1,48 @@
+package nessielight
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// keys of User.Preference
+const (
+	// how proxies are sent in telegram, ProxyFormatText or ProxyFormatQRCode
+	PrefProxyFormat = "proxy_format"
+)
+
+// values of PrefProxyFormat
+const (
+	ProxyFormatText   = "text"
+	ProxyFormatQRCode = "qrcode"
+)
+
+// preferences of a user, stored as json object
+type preferenceMap map[string]string
+
+func (r preferenceMap) Value() (driver.Value, error) {
+	if len(r) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(map[string]string(r))
+	return string(b), err
+}
+
+func (r *preferenceMap) Scan(src interface{}) error {
+	var text []byte
+	switch v := src.(type) {
+	case nil:
+	case string:
+		text = []byte(v)
+	case []byte:
+		text = v
+	default:
+		return fmt.Errorf("cannot scan %T into preferenceMap", src)
+	}
+	*r = preferenceMap{}
+	if len(text) == 0 {
+		return nil
+	}
+	return json.Unmarshal(text, (*map[string]string)(r))
+}
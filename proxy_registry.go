@@ -0,0 +1,258 @@
+package nessielight
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+// ProxyType describes a kind of Proxy, registered by RegisterProxyType
+type ProxyType struct {
+	// gorm model of this kind, migrated by InitDBwithFile
+	Model interface{}
+	// load a stored proxy by its ProxyID
+	Load func(id uint) (Proxy, error)
+	// create and store a new proxy
+	New func() (Proxy, error)
+	// whether new users get a proxy of this kind by default
+	Enabled func() bool
+}
+
+var proxyTypes = make(map[string]ProxyType)
+
+// registration order, also the order of proxies generated by NewUserProxies
+var proxyTypeNames []string
+
+// register a kind of proxy by name. name is stored in database, so never change it
+func RegisterProxyType(name string, t ProxyType) {
+	if _, ok := proxyTypes[name]; ok {
+		panic(fmt.Errorf("proxy type %s registered twice", name))
+	}
+	if strings.ContainsAny(name, ":,") {
+		panic(fmt.Errorf("invalid proxy type name %s", name))
+	}
+	proxyTypes[name] = t
+	proxyTypeNames = append(proxyTypeNames, name)
+}
+
+// names of all registered proxy types
+func ProxyTypes() []string {
+	return append([]string{}, proxyTypeNames...)
+}
+
+// names of proxy types which new proxies can be created of
+func EnabledProxyTypes() []string {
+	var names []string
+	for _, name := range proxyTypeNames {
+		if t := proxyTypes[name]; t.Enabled == nil || t.Enabled() {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func LoadProxy(name string, id uint) (Proxy, error) {
+	t, ok := proxyTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown proxy type %s", name)
+	}
+	return t.Load(id)
+}
+
+func NewProxyOf(name string) (Proxy, error) {
+	t, ok := proxyTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown proxy type %s", name)
+	}
+	return t.New()
+}
+
+// generate a new set of proxies for a user, one for each enabled type
+func NewUserProxies() []Proxy {
+	var proxies []Proxy
+	for _, name := range proxyTypeNames {
+		if t := proxyTypes[name]; t.Enabled == nil || t.Enabled() {
+			if proxy, err := t.New(); err != nil {
+				logger.Print("NewUserProxies: ", err)
+			} else {
+				proxies = append(proxies, proxy)
+			}
+		}
+	}
+	return proxies
+}
+
+// reference to a proxy stored in the table of its type
+type proxyRef struct {
+	Type string
+	ID   uint
+}
+
+// stored as text like "vmess:1,vless:3"
+type proxyRefList []proxyRef
+
+func (r proxyRefList) Value() (driver.Value, error) {
+	items := make([]string, len(r))
+	for i, v := range r {
+		items[i] = fmt.Sprintf("%s:%d", v.Type, v.ID)
+	}
+	return strings.Join(items, ","), nil
+}
+
+func (r *proxyRefList) Scan(src interface{}) error {
+	var text string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into proxyRefList", src)
+	}
+	*r = proxyRefList{}
+	if text == "" {
+		return nil
+	}
+	for _, item := range strings.Split(text, ",") {
+		sep := strings.LastIndexByte(item, ':')
+		if sep < 0 {
+			return fmt.Errorf("invalid proxy reference %s", item)
+		}
+		id, err := strconv.ParseUint(item[sep+1:], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid proxy reference %s", item)
+		}
+		*r = append(*r, proxyRef{Type: item[:sep], ID: uint(id)})
+	}
+	return nil
+}
+
+// users used to keep proxy id of each type in its own column, in the order
+// proxies are listed after migration
+var legacyProxyColumns = []struct {
+	column, name string
+}{
+	{"v2ray_proxy_id", "vmess"},
+	{"vless_proxy_id", "vless"},
+	{"trojan_proxy_id", "trojan"},
+	{"ss_proxy_id", "shadowsocks"},
+}
+
+// move proxy id from legacy columns into simpleUser.Proxies. Each user is
+// migrated in a transaction which also clears its legacy columns, so a
+// migration interrupted by a crash resumes without duplicating proxies
+func migrateLegacyProxyColumns() error {
+	migrator := DataBase.Migrator()
+	var columns []string
+	names := make(map[string]string)
+	for _, v := range legacyProxyColumns {
+		if migrator.HasColumn(&simpleUser{}, v.column) {
+			columns = append(columns, v.column)
+			names[v.column] = v.name
+		}
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+	var users []simpleUser
+	if err := DataBase.Find(&users).Error; err != nil {
+		return err
+	}
+	for _, user := range users {
+		err := DataBase.Transaction(func(tx *gorm.DB) error {
+			updates := map[string]interface{}{}
+			for _, column := range columns {
+				var ids pq.Int32Array
+				row := tx.Model(&simpleUser{}).Select(column).Where("id = ?", user.ID).Row()
+				if err := row.Scan(&ids); err != nil {
+					return err
+				}
+				for _, id := range ids {
+					user.Proxies = append(user.Proxies, proxyRef{Type: names[column], ID: uint(id)})
+				}
+				updates[column] = nil
+			}
+			updates["proxies"] = user.Proxies
+			return tx.Model(&simpleUser{}).Where("id = ?", user.ID).Updates(updates).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, column := range columns {
+		if err := migrator.DropColumn(&simpleUser{}, column); err != nil {
+			return err
+		}
+		logger.Printf("migrated legacy column %s to proxy type %s", column, names[column])
+	}
+	return nil
+}
+
+func init() {
+	RegisterProxyType("vmess", ProxyType{
+		Model: &v2rayProxy{},
+		Load: func(id uint) (Proxy, error) {
+			var proxy v2rayProxy
+			if err := DataBase.First(&proxy, id).Error; err != nil {
+				return nil, err
+			}
+			return &proxy, nil
+		},
+		New: func() (Proxy, error) {
+			return V2rayServiceInstance.NewProxy(), nil
+		},
+	})
+	RegisterProxyType("vless", ProxyType{
+		Model: &vlessProxy{},
+		Load: func(id uint) (Proxy, error) {
+			var proxy vlessProxy
+			if err := DataBase.First(&proxy, id).Error; err != nil {
+				return nil, err
+			}
+			return &proxy, nil
+		},
+		New: func() (Proxy, error) {
+			return V2rayServiceInstance.NewVlessProxy(), nil
+		},
+		Enabled: func() bool {
+			return V2rayServiceInstance.(*v2rayClient).vlessTag != ""
+		},
+	})
+	RegisterProxyType("trojan", ProxyType{
+		Model: &trojanProxy{},
+		Load: func(id uint) (Proxy, error) {
+			var proxy trojanProxy
+			if err := DataBase.First(&proxy, id).Error; err != nil {
+				return nil, err
+			}
+			return &proxy, nil
+		},
+		New: func() (Proxy, error) {
+			return V2rayServiceInstance.NewTrojanProxy(), nil
+		},
+		Enabled: func() bool {
+			return V2rayServiceInstance.(*v2rayClient).trojanTag != ""
+		},
+	})
+	RegisterProxyType("shadowsocks", ProxyType{
+		Model: &shadowsocksProxy{},
+		Load: func(id uint) (Proxy, error) {
+			var proxy shadowsocksProxy
+			if err := DataBase.First(&proxy, id).Error; err != nil {
+				return nil, err
+			}
+			return &proxy, nil
+		},
+		New: func() (Proxy, error) {
+			return V2rayServiceInstance.NewShadowsocksProxy()
+		},
+		Enabled: func() bool {
+			return V2rayServiceInstance.(*v2rayClient).ssTag != ""
+		},
+	})
+}
@@ -0,0 +1,481 @@
+// package qrcode encodes text as QR code in byte mode with error correction level M
+package qrcode
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// error correction codewords per block of level M, indexed by version
+var eccCodewordsPerBlock = [41]int{-1,
+	10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26,
+	26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+
+// error correction blocks of level M, indexed by version
+var numErrorCorrectionBlocks = [41]int{-1,
+	1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16,
+	17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+
+// format bits of error correction level M
+const formatBitsM = 0
+
+// QR code symbol. Modules[y][x] is true for dark modules
+type Code struct {
+	Version int
+	Size    int
+	Modules [][]bool
+	// function patterns, which are not masked
+	isFunction [][]bool
+}
+
+// encode data in the smallest version that fits
+func Encode(data []byte) (*Code, error) {
+	version := 0
+	for v := 1; v <= 40; v++ {
+		if 4+countBits(v)+len(data)*8 <= numDataCodewords(v)*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("data too long: %d bytes", len(data))
+	}
+
+	// byte mode segment, terminator and padding
+	var bits bitBuffer
+	bits.append(0x4, 4)
+	bits.append(len(data), countBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := numDataCodewords(version) * 8
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i>>3] |= 1 << (7 - i&7)
+		}
+	}
+
+	code := &Code{Version: version, Size: version*4 + 17}
+	code.Modules = make([][]bool, code.Size)
+	code.isFunction = make([][]bool, code.Size)
+	for i := range code.Modules {
+		code.Modules[i] = make([]bool, code.Size)
+		code.isFunction[i] = make([]bool, code.Size)
+	}
+	code.drawFunctionPatterns()
+	code.drawCodewords(addEccAndInterleave(codewords, version))
+
+	// choose the mask with the lowest penalty
+	best, minPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		code.applyMask(mask)
+		code.drawFormatBits(mask)
+		if penalty := code.penalty(); minPenalty < 0 || penalty < minPenalty {
+			best, minPenalty = mask, penalty
+		}
+		// masks are xor, so applying again reverts
+		code.applyMask(mask)
+	}
+	code.applyMask(best)
+	code.drawFormatBits(best)
+	return code, nil
+}
+
+// render the code with a quiet zone of 4 modules, scale pixels per module
+func (r *Code) Image(scale int) image.Image {
+	size := (r.Size + 8) * scale
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			mx, my := x/scale-4, y/scale-4
+			c := color.Gray{Y: 255}
+			if mx >= 0 && mx < r.Size && my >= 0 && my < r.Size && r.Modules[my][mx] {
+				c = color.Gray{Y: 0}
+			}
+			img.SetGray(x, y, c)
+		}
+	}
+	return img
+}
+
+// encode text as QR code in PNG
+func PNG(text string, scale int) ([]byte, error) {
+	code, err := Encode([]byte(text))
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := png.Encode(&b, code.Image(scale)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+type bitBuffer []bool
+
+func (r *bitBuffer) append(val, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*r = append(*r, (val>>i)&1 != 0)
+	}
+}
+
+// bits of character count in byte mode
+func countBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// modules available for data and error correction, excluding function patterns
+func numRawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		result -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+func numDataCodewords(version int) int {
+	return numRawDataModules(version)/8 - eccCodewordsPerBlock[version]*numErrorCorrectionBlocks[version]
+}
+
+// split data into blocks, append error correction to each block and interleave them
+func addEccAndInterleave(data []byte, version int) []byte {
+	numBlocks := numErrorCorrectionBlocks[version]
+	blockEccLen := eccCodewordsPerBlock[version]
+	rawCodewords := numRawDataModules(version) / 8
+	numShortBlocks := numBlocks - rawCodewords%numBlocks
+	shortBlockLen := rawCodewords / numBlocks
+
+	divisor := reedSolomonDivisor(blockEccLen)
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := range blocks {
+		dataLen := shortBlockLen - blockEccLen
+		if i >= numShortBlocks {
+			dataLen++
+		}
+		block := append([]byte{}, data[k:k+dataLen]...)
+		k += dataLen
+		ecc := reedSolomonRemainder(block, divisor)
+		if i < numShortBlocks {
+			// placeholder keeping all blocks the same length
+			block = append(block, 0)
+		}
+		blocks[i] = append(block, ecc...)
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := 0; i <= shortBlockLen; i++ {
+		for j, block := range blocks {
+			if i != shortBlockLen-blockEccLen || j >= numShortBlocks {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+// generator polynomial of degree, highest coefficient first and the leading 1 omitted
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// multiply in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+func (r *Code) setFunction(x, y int, dark bool) {
+	r.Modules[y][x] = dark
+	r.isFunction[y][x] = true
+}
+
+func (r *Code) drawFunctionPatterns() {
+	for i := 0; i < r.Size; i++ {
+		r.setFunction(6, i, i%2 == 0)
+		r.setFunction(i, 6, i%2 == 0)
+	}
+	r.drawFinderPattern(3, 3)
+	r.drawFinderPattern(r.Size-4, 3)
+	r.drawFinderPattern(3, r.Size-4)
+
+	positions := r.alignmentPositions()
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// skip the three finder corners
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			r.drawAlignmentPattern(x, y)
+		}
+	}
+
+	// reserve format area, drawn again after masking
+	r.drawFormatBits(0)
+	r.drawVersion()
+}
+
+func (r *Code) drawFinderPattern(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			dist := max(abs(dx), abs(dy))
+			xx, yy := x+dx, y+dy
+			if xx >= 0 && xx < r.Size && yy >= 0 && yy < r.Size {
+				r.setFunction(xx, yy, dist != 2 && dist != 4)
+			}
+		}
+	}
+}
+
+func (r *Code) drawAlignmentPattern(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			r.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// centers of alignment patterns in both dimensions, ascending
+func (r *Code) alignmentPositions() []int {
+	if r.Version == 1 {
+		return nil
+	}
+	numAlign := r.Version/7 + 2
+	step := (r.Version*8 + numAlign*3 + 5) / (numAlign*4 - 4) * 2
+	result := make([]int, numAlign)
+	result[0] = 6
+	for i, pos := numAlign-1, r.Size-7; i >= 1; i, pos = i-1, pos-step {
+		result[i] = pos
+	}
+	return result
+}
+
+func (r *Code) drawFormatBits(mask int) {
+	data := formatBitsM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool {
+		return (bits>>i)&1 != 0
+	}
+
+	// around the top left finder
+	for i := 0; i <= 5; i++ {
+		r.setFunction(8, i, bit(i))
+	}
+	r.setFunction(8, 7, bit(6))
+	r.setFunction(8, 8, bit(7))
+	r.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		r.setFunction(14-i, 8, bit(i))
+	}
+	// the other copy
+	for i := 0; i < 8; i++ {
+		r.setFunction(r.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		r.setFunction(8, r.Size-15+i, bit(i))
+	}
+	// dark module
+	r.setFunction(8, r.Size-8, true)
+}
+
+func (r *Code) drawVersion() {
+	if r.Version < 7 {
+		return
+	}
+	rem := r.Version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := r.Version<<12 | rem
+	for i := 0; i < 18; i++ {
+		bit := (bits>>i)&1 != 0
+		a, b := r.Size-11+i%3, i/3
+		r.setFunction(a, b, bit)
+		r.setFunction(b, a, bit)
+	}
+}
+
+// place codewords in zigzag column pairs from the bottom right
+func (r *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := r.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < r.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				upward := (right+1)&2 == 0
+				y := vert
+				if upward {
+					y = r.Size - 1 - vert
+				}
+				if !r.isFunction[y][x] && i < len(data)*8 {
+					r.Modules[y][x] = (data[i>>3]>>(7-i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (r *Code) applyMask(mask int) {
+	for y := 0; y < r.Size; y++ {
+		for x := 0; x < r.Size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !r.isFunction[y][x] {
+				r.Modules[y][x] = !r.Modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty score of the spec, lower is easier to scan
+func (r *Code) penalty() int {
+	result := 0
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return r.Modules[x][y]
+		}
+		return r.Modules[y][x]
+	}
+	// runs of the same color and finder-like patterns, in rows and columns
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < r.Size; y++ {
+			run := 1
+			for x := 1; x <= r.Size; x++ {
+				if x < r.Size && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					result += run - 2
+				}
+				run = 1
+			}
+			for x := 0; x+11 <= r.Size; x++ {
+				for _, pattern := range finderLike {
+					match := true
+					for k, dark := range pattern {
+						if at(x+k, y, transpose) != dark {
+							match = false
+							break
+						}
+					}
+					if match {
+						result += 40
+					}
+				}
+			}
+		}
+	}
+	// 2x2 blocks of the same color
+	dark := 0
+	for y := 0; y < r.Size; y++ {
+		for x := 0; x < r.Size; x++ {
+			if r.Modules[y][x] {
+				dark++
+			}
+			if x+1 < r.Size && y+1 < r.Size {
+				c := r.Modules[y][x]
+				if c == r.Modules[y][x+1] && c == r.Modules[y+1][x] && c == r.Modules[y+1][x+1] {
+					result += 3
+				}
+			}
+		}
+	}
+	// balance of dark and light modules
+	total := r.Size * r.Size
+	result += ((abs(dark*20-total*10)+total-1)/total - 1) * 10
+	return result
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func max(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
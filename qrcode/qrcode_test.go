@@ -0,0 +1,108 @@
+package qrcode
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// deterministic text without long runs, so it takes several blocks
+func sequence(n int) string {
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = chars[(i*7+i/36)%len(chars)]
+	}
+	return string(b)
+}
+
+func render(code *Code) string {
+	var b strings.Builder
+	for _, row := range code.Modules {
+		for _, dark := range row {
+			if dark {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// golden matrices in testdata are generated by rsc.io/qr/coding with the
+// same version, level M and the mask chosen by Encode
+func TestEncodeGolden(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		version int
+	}{
+		{"hello", "hello", 1},
+		{"url", "https://example.com/sub/abcdef", 3},
+		{"vless", "vless://0a1b2c3d-4e5f-6789-abcd-ef0123456789@proxy.example.com:443?security=tls&type=ws&path=%2Fws#proxy.example.com_vless_1", 8},
+		{"v9max", strings.Repeat("x", 180), 9},
+		{"v10min", strings.Repeat("z", 181), 10},
+		{"long", sequence(1000), 26},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := os.ReadFile("testdata/" + tt.name + ".txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, err := Encode([]byte(tt.text))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code.Version != tt.version {
+				t.Errorf("version = %d, want %d", code.Version, tt.version)
+			}
+			if code.Size != tt.version*4+17 || len(code.Modules) != code.Size {
+				t.Fatalf("size = %d with %d rows, want %d", code.Size, len(code.Modules), tt.version*4+17)
+			}
+			if got := render(code); got != string(want) {
+				t.Errorf("modules differ from testdata/%s.txt, got\n%s", tt.name, got)
+			}
+		})
+	}
+}
+
+// byte capacities of level M, as computed by rsc.io/qr/coding, are the largest
+// data for each version
+func TestEncodeVersionBoundary(t *testing.T) {
+	tests := []struct {
+		length  int
+		version int
+	}{
+		{0, 1},
+		{14, 1},
+		{15, 2},
+		{26, 2},
+		{27, 3},
+		{122, 7},
+		{123, 8},
+		{180, 9},
+		// the character count takes 16 bits from version 10
+		{181, 10},
+		{213, 10},
+		{214, 11},
+		{2213, 39},
+		{2214, 40},
+		{2331, 40},
+	}
+	for _, tt := range tests {
+		code, err := Encode([]byte(sequence(tt.length)))
+		if err != nil {
+			t.Errorf("length %d: %s", tt.length, err.Error())
+			continue
+		}
+		if code.Version != tt.version {
+			t.Errorf("length %d: version = %d, want %d", tt.length, code.Version, tt.version)
+		}
+	}
+	if _, err := Encode([]byte(sequence(2332))); err == nil {
+		t.Error("length 2332: want error")
+	}
+}
@@ -0,0 +1,223 @@
+package nessielight
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Project-Nessie/nessielight/utils"
+)
+
+// reasons of suspension, see User.Suspension
+const (
+	SuspendedByQuota  = "quota"
+	SuspendedByExpiry = "expiry"
+)
+
+var ErrUserSuspended = errors.New("user is suspended")
+
+// traffic limit of a user. Zero fields are unlimited
+type TrafficQuota struct {
+	Uplink, Downlink utils.ByteValue
+	// limit of uplink + downlink
+	Total utils.ByteValue
+}
+
+func (r TrafficQuota) Unlimited() bool {
+	return r.Uplink == 0 && r.Downlink == 0 && r.Total == 0
+}
+
+func (r TrafficQuota) Exceeded(traffic TrafficValue) bool {
+	return (r.Uplink > 0 && traffic.Uplink >= r.Uplink) ||
+		(r.Downlink > 0 && traffic.Downlink >= r.Downlink) ||
+		(r.Total > 0 && traffic.Uplink+traffic.Downlink >= r.Total)
+}
+
+// highest percent of limits used by traffic, 0 if unlimited
+func (r TrafficQuota) Percent(traffic TrafficValue) int {
+	percent := 0
+	used := func(value, limit utils.ByteValue) {
+		if limit > 0 {
+			if p := int(value * 100 / limit); p > percent {
+				percent = p
+			}
+		}
+	}
+	used(traffic.Uplink, r.Uplink)
+	used(traffic.Downlink, r.Downlink)
+	used(traffic.Uplink+traffic.Downlink, r.Total)
+	return percent
+}
+
+func (r TrafficQuota) String() string {
+	if r.Unlimited() {
+		return "unlimited"
+	}
+	var items []string
+	if r.Uplink > 0 {
+		items = append(items, "up="+r.Uplink.String())
+	}
+	if r.Downlink > 0 {
+		items = append(items, "down="+r.Downlink.String())
+	}
+	if r.Total > 0 {
+		items = append(items, "total="+r.Total.String())
+	}
+	return strings.Join(items, ",")
+}
+
+var byteUnits = map[string]float64{
+	"":   1,
+	"B":  1,
+	"KB": 1e3,
+	"MB": 1e6,
+	"GB": 1e9,
+	"TB": 1e12,
+}
+
+// parse size like 1.5GB, in the same unit as utils.ByteValue prints
+func ParseByteValue(text string) (utils.ByteValue, error) {
+	text = strings.ToUpper(strings.TrimSpace(text))
+	i := strings.IndexFunc(text, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(text)
+	}
+	unit, ok := byteUnits[strings.TrimSpace(text[i:])]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %s", text)
+	}
+	num, err := strconv.ParseFloat(text[:i], 64)
+	if err != nil || num < 0 {
+		return 0, fmt.Errorf("invalid size %s", text)
+	}
+	return utils.ByteValue(num * unit), nil
+}
+
+// parse quota like "total=100GB", "up=10GB,down=100GB", or "0" for unlimited
+func ParseTrafficQuota(text string) (TrafficQuota, error) {
+	var quota TrafficQuota
+	text = strings.TrimSpace(text)
+	if text == "0" || text == "unlimited" {
+		return quota, nil
+	}
+	for _, item := range strings.Split(text, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return quota, fmt.Errorf("invalid quota %s", item)
+		}
+		value, err := ParseByteValue(kv[1])
+		if err != nil {
+			return quota, err
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "up":
+			quota.Uplink = value
+		case "down":
+			quota.Downlink = value
+		case "total":
+			quota.Total = value
+		default:
+			return quota, fmt.Errorf("invalid quota %s", item)
+		}
+	}
+	return quota, nil
+}
+
+// suspend a user who exceeds quota, or resume a user suspended by quota if the
+// quota is raised or traffic is reset, unless the user has expired meanwhile.
+// The user is saved if changed
+func EnforceQuota(user User) error {
+	exceeded := user.Quota().Exceeded(user.Traffic())
+	switch {
+	case exceeded && user.Suspension() == "":
+		for _, p := range user.Proxy() {
+			if err := p.Deactivate(); err != nil {
+				logger.Printf("EnforceQuota: deactivate proxy %d of user %d: %s", p.ProxyID(), user.TelegramID(), err.Error())
+			}
+		}
+		if err := user.SetSuspension(SuspendedByQuota); err != nil {
+			return err
+		}
+		logger.Printf("user %d is suspended, traffic %v exceeds quota %v", user.TelegramID(), user.Traffic(), user.Quota())
+		if err := UserManagerInstance.SetUser(user); err != nil {
+			return err
+		}
+		Notify(user, EventSuspended, NotifyData{})
+	case !exceeded && user.Suspension() == SuspendedByQuota && !Expired(user, time.Now()):
+		if err := user.SetSuspension(""); err != nil {
+			return err
+		}
+		if err := UserManagerInstance.SetUser(user); err != nil {
+			return err
+		}
+		logger.Printf("user %d is resumed, quota %v", user.TelegramID(), user.Quota())
+		return ApplyUserProxy(user)
+	}
+	return nil
+}
+
+// percents of quota notified to users, see EventQuotaWarning and EventQuotaReached
+var quotaLevels = []int{80, 100}
+
+// preference keeping the highest level in quotaLevels notified in the current
+// billing cycle, as "<level>@<cycle start unix time>"
+const prefQuotaNotified = "quota_notified"
+
+// notify user when traffic reaches a higher level of quota. The level is
+// lowered silently if the quota is raised, so it can be notified again
+func checkQuotaLevel(user User) error {
+	percent := user.Quota().Percent(user.Traffic())
+	level := 0
+	for _, v := range quotaLevels {
+		if percent >= v {
+			level = v
+		}
+	}
+	cycle := strconv.FormatInt(user.CycleStart().Unix(), 10)
+	notified := 0
+	if items := strings.SplitN(user.Preference(prefQuotaNotified), "@", 2); len(items) == 2 && items[1] == cycle {
+		notified, _ = strconv.Atoi(items[0])
+	}
+	if level == notified {
+		return nil
+	}
+	value := fmt.Sprintf("%d@%s", level, cycle)
+	if level == 0 {
+		value = ""
+	}
+	if err := user.SetPreference(prefQuotaNotified, value); err != nil {
+		return err
+	}
+	if err := UserManagerInstance.SetUser(user); err != nil {
+		return err
+	}
+	switch {
+	case level < notified:
+	case level >= 100:
+		Notify(user, EventQuotaReached, NotifyData{Percent: percent})
+	default:
+		Notify(user, EventQuotaWarning, NotifyData{Percent: percent})
+	}
+	return nil
+}
+
+// notify and enforce quota of all users
+func CheckQuotas() error {
+	users, err := UserManagerInstance.All()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := checkQuotaLevel(user); err != nil {
+			return err
+		}
+		if err := EnforceQuota(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package nessielight
+
+import (
+	"testing"
+
+	"github.com/Project-Nessie/nessielight/utils"
+)
+
+func TestParseByteValue(t *testing.T) {
+	tests := []struct {
+		text string
+		want utils.ByteValue
+		err  bool
+	}{
+		{"0", 0, false},
+		{"100", 100, false},
+		{"100B", 100, false},
+		{"1KB", 1e3, false},
+		{"1.5GB", 1.5e9, false},
+		{"10 mb", 1e7, false},
+		{" 2TB ", 2e12, false},
+		{".5GB", 5e8, false},
+		{"", 0, true},
+		{"GB", 0, true},
+		{"-1GB", 0, true},
+		{"1PB", 0, true},
+		{"1.2.3GB", 0, true},
+		{"1GiB", 0, true},
+		{"abc", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseByteValue(tt.text)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseByteValue(%q) error = %v, want error %v", tt.text, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseByteValue(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseTrafficQuota(t *testing.T) {
+	tests := []struct {
+		text string
+		want TrafficQuota
+		err  bool
+	}{
+		{"0", TrafficQuota{}, false},
+		{"unlimited", TrafficQuota{}, false},
+		{" 0 ", TrafficQuota{}, false},
+		{"total=100GB", TrafficQuota{Total: 100e9}, false},
+		{"up=10GB,down=100GB", TrafficQuota{Uplink: 10e9, Downlink: 100e9}, false},
+		{"up=1GB, total = 2GB", TrafficQuota{Uplink: 1e9, Total: 2e9}, false},
+		{"total=1GB,total=2GB", TrafficQuota{Total: 2e9}, false},
+		{"", TrafficQuota{}, true},
+		{"100GB", TrafficQuota{}, true},
+		{"total", TrafficQuota{}, true},
+		{"total=abc", TrafficQuota{}, true},
+		{"side=1GB", TrafficQuota{}, true},
+		{"total=1GB,", TrafficQuota{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTrafficQuota(tt.text)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseTrafficQuota(%q) error = %v, want error %v", tt.text, err, tt.err)
+			continue
+		}
+		if !tt.err && got != tt.want {
+			t.Errorf("ParseTrafficQuota(%q) = %+v, want %+v", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package nessielight
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// role of a telegram user, which grants a set of permissions
+type Role string
+
+const (
+	// all permissions, including granting roles
+	RoleOwner Role = "owner"
+	// all permissions except granting roles
+	RoleAdmin Role = "admin"
+	// service maintenance and viewing statistics
+	RoleOperator Role = "operator"
+	// no permission, default role of everyone
+	RoleUser Role = "user"
+)
+
+var Roles = []Role{RoleOwner, RoleAdmin, RoleOperator, RoleUser}
+
+// named permission checked by bot commands and buttons
+type Permission string
+
+const (
+	PermAdminPanel     Permission = "admin.panel"
+	PermUserAdd        Permission = "user.add"
+	PermUserDelete     Permission = "user.delete"
+	PermUserEdit       Permission = "user.edit"
+	PermRequestReview  Permission = "request.review"
+	PermTrafficView    Permission = "traffic.view"
+	PermTrafficReset   Permission = "traffic.reset"
+	PermServiceStatus  Permission = "service.status"
+	PermServiceRestart Permission = "service.restart"
+	PermLogView        Permission = "log.view"
+	PermRoleManage     Permission = "role.manage"
+	PermBroadcast      Permission = "broadcast.send"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleOwner: {PermAdminPanel, PermUserAdd, PermUserDelete, PermUserEdit, PermRequestReview,
+		PermTrafficView, PermTrafficReset, PermServiceStatus, PermServiceRestart, PermLogView, PermBroadcast, PermRoleManage},
+	RoleAdmin: {PermAdminPanel, PermUserAdd, PermUserDelete, PermUserEdit, PermRequestReview,
+		PermTrafficView, PermTrafficReset, PermServiceStatus, PermServiceRestart, PermLogView, PermBroadcast},
+	RoleOperator: {PermAdminPanel, PermTrafficView, PermServiceStatus, PermServiceRestart, PermLogView},
+	RoleUser:     {},
+}
+
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+func (r Role) Permissions() []Permission {
+	return rolePermissions[r]
+}
+
+func (r Role) Can(perm Permission) bool {
+	for _, v := range rolePermissions[r] {
+		if v == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// role granted to a telegram user. Users without a record have RoleUser
+type roleAssignment struct {
+	gorm.Model
+	TelegramID int `gorm:"uniqueIndex"`
+	Role       Role
+	// telegram id of the owner granting the role, 0 for bootstrap
+	GrantedBy int
+}
+
+type RoleAssignment struct {
+	TelegramID int
+	Role       Role
+	GrantedBy  int
+	UpdatedAt  time.Time
+}
+
+// role of a telegram user, who need not be a registered user
+func RoleOf(tid int) (Role, error) {
+	var record roleAssignment
+	if err := DataBase.Where("telegram_id = ?", tid).First(&record).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return RoleUser, nil
+		}
+		return RoleUser, err
+	}
+	return record.Role, nil
+}
+
+// whether the role of a telegram user has perm, false on database errors
+func HasPermission(tid int, perm Permission) bool {
+	role, err := RoleOf(tid)
+	if err != nil {
+		logger.Printf("role of %d: %v", tid, err)
+		return false
+	}
+	return role.Can(perm)
+}
+
+// grant role to tid, RoleUser revokes the granted role. The last owner cannot
+// be removed, so the bot is always manageable
+func SetRole(tid int, role Role, by int) error {
+	if !role.Valid() {
+		return fmt.Errorf("unknown role %s", role)
+	}
+	old, err := RoleOf(tid)
+	if err != nil {
+		return err
+	}
+	if old == RoleOwner && role != RoleOwner {
+		var owners int64
+		if err := DataBase.Model(&roleAssignment{}).Where("role = ?", RoleOwner).Count(&owners).Error; err != nil {
+			return err
+		}
+		if owners <= 1 {
+			return errors.New("cannot remove the last owner")
+		}
+	}
+	if role == RoleUser {
+		if err := DataBase.Unscoped().Where("telegram_id = ?", tid).Delete(&roleAssignment{}).Error; err != nil {
+			return err
+		}
+	} else {
+		var record roleAssignment
+		if err := DataBase.Where(roleAssignment{TelegramID: tid}).
+			Assign(roleAssignment{Role: role, GrantedBy: by}).
+			FirstOrCreate(&record).Error; err != nil {
+			return err
+		}
+	}
+	logger.Printf("role of %d: %s -> %s, by %d", tid, old, role, by)
+	return nil
+}
+
+// all granted roles, ordered by role and telegram id
+func RoleAssignments() ([]RoleAssignment, error) {
+	var records []roleAssignment
+	if err := DataBase.Order("telegram_id").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	assignments := make([]RoleAssignment, 0, len(records))
+	for _, role := range Roles {
+		for _, v := range records {
+			if v.Role == role {
+				assignments = append(assignments, RoleAssignment{
+					TelegramID: v.TelegramID,
+					Role:       v.Role,
+					GrantedBy:  v.GrantedBy,
+					UpdatedAt:  v.UpdatedAt,
+				})
+			}
+		}
+	}
+	return assignments, nil
+}
+
+// telegram users with perm
+func UsersWithPermission(perm Permission) ([]int, error) {
+	assignments, err := RoleAssignments()
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, v := range assignments {
+		if v.Role.Can(perm) {
+			ids = append(ids, v.TelegramID)
+		}
+	}
+	return ids, nil
+}
+
+// grant RoleOwner to tids if there is no owner yet, e.g. on first start
+func BootstrapOwners(tids []int) error {
+	var owners int64
+	if err := DataBase.Model(&roleAssignment{}).Where("role = ?", RoleOwner).Count(&owners).Error; err != nil {
+		return err
+	}
+	if owners > 0 {
+		return nil
+	}
+	for _, tid := range tids {
+		if err := SetRole(tid, RoleOwner, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+package nessielight
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// when a job runs
+type Schedule interface {
+	// first run time after t
+	Next(t time.Time) time.Time
+	String() string
+}
+
+// run at a fixed interval
+type intervalSchedule time.Duration
+
+func (r intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(r))
+}
+
+func (r intervalSchedule) String() string {
+	return "every " + time.Duration(r).String()
+}
+
+// cron expression of 5 fields: minute, hour, day of month, month and day of
+// week. Each field is a set of allowed values
+type cronSchedule struct {
+	text                          string
+	minute, hour, dom, month, dow uint64
+	domRestricted, dowRestricted  bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parse a field like "*", "*/15", "1-5", "0,30" or "9-17/2" into a bit set
+func parseCronField(text string, min, max int) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(text, ",") {
+		step := 1
+		if i := strings.IndexByte(item, '/'); i >= 0 {
+			s, err := strconv.Atoi(item[i+1:])
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("invalid step %s", item)
+			}
+			step = s
+			item = item[:i]
+		}
+		lo, hi := min, max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %s", item)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %s", item)
+				}
+			} else if step > 1 {
+				// "5/15" means from 5 to max
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value %s out of range %d-%d", item, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func parseCron(text string) (*cronSchedule, error) {
+	fields := strings.Fields(text)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression %q should have %d fields", text, len(cronFields))
+	}
+	sets := make([]uint64, len(fields))
+	for i, f := range cronFields {
+		set, err := parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s of %q: %s", f.name, text, err.Error())
+		}
+		sets[i] = set
+	}
+	// both 0 and 7 are sunday
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &cronSchedule{
+		text:          text,
+		minute:        sets[0],
+		hour:          sets[1],
+		dom:           sets[2],
+		month:         sets[3],
+		dow:           sets[4],
+		domRestricted: fields[2] != "*",
+		dowRestricted: fields[4] != "*",
+	}, nil
+}
+
+func (r *cronSchedule) dayMatches(t time.Time) bool {
+	dom := r.dom&(1<<uint(t.Day())) != 0
+	dow := r.dow&(1<<uint(t.Weekday())) != 0
+	// like cron, either matches if both are restricted
+	if r.domRestricted && r.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+func (r *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// a matching time exists within a few years unless the expression is like
+	// "0 0 31 2 *", which never matches
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case r.month&(1<<uint(t.Month())) == 0:
+			t = cronDate(t.Year(), t.Month()+1, 1, 0, t.Location())
+		case !r.dayMatches(t):
+			t = cronDate(t.Year(), t.Month(), t.Day()+1, 0, t.Location())
+		case r.hour&(1<<uint(t.Hour())) == 0:
+			// not Truncate, which works in UTC and breaks zones like +05:30
+			t = cronDate(t.Year(), t.Month(), t.Day(), t.Hour()+1, t.Location())
+		case r.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// like time.Date, but a time skipped by DST moves forward to the end of the
+// gap. time.Date moves it backward, which would make Next loop
+func cronDate(year int, month time.Month, day, hour int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, hour, 0, 0, 0, loc)
+	want := time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+	got := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+	if gap := want.Sub(got); gap > 0 {
+		t = t.Add(gap)
+	}
+	return t
+}
+
+func (r *cronSchedule) String() string {
+	return "cron " + r.text
+}
+
+// parse an interval like "5m", or a cron expression like "0 9 * * *" in local time
+func ParseSchedule(text string) (Schedule, error) {
+	if d, err := time.ParseDuration(text); err == nil {
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid interval %s", text)
+		}
+		return intervalSchedule(d), nil
+	}
+	return parseCron(text)
+}
+
+// state of a job shown to admins
+type JobStatus struct {
+	Name     string
+	Schedule string
+	Running  bool
+	// zero if never run
+	LastRun      time.Time
+	LastDuration time.Duration
+	// error of the last run, empty if succeeded
+	LastError string
+	NextRun   time.Time
+	Runs      int
+}
+
+type job struct {
+	run      func(now time.Time) error
+	schedule Schedule
+	status   JobStatus
+}
+
+// runs jobs periodically, each job in its own goroutine so a slow job does
+// not delay others. Runs of the same job never overlap
+type Scheduler struct {
+	mu      sync.Mutex
+	jobs    []*job
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	started bool
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{stop: make(chan struct{})}
+}
+
+// add a job before Start. name identifies the job in status
+func (r *Scheduler) Add(name string, schedule Schedule, run func(now time.Time) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.started {
+		panic(fmt.Errorf("job %s added after scheduler started", name))
+	}
+	r.jobs = append(r.jobs, &job{
+		run:      run,
+		schedule: schedule,
+		status:   JobStatus{Name: name, Schedule: schedule.String()},
+	})
+}
+
+func (r *Scheduler) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.started {
+		return
+	}
+	r.started = true
+	for _, j := range r.jobs {
+		r.wg.Add(1)
+		go r.loop(j)
+	}
+}
+
+func (r *Scheduler) loop(j *job) {
+	defer r.wg.Done()
+	for {
+		next := j.schedule.Next(time.Now())
+		r.mu.Lock()
+		j.status.NextRun = next
+		r.mu.Unlock()
+		if next.IsZero() {
+			logger.Printf("job %s will never run", j.status.Name)
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-r.stop:
+			timer.Stop()
+			return
+		case now := <-timer.C:
+			r.runJob(j, now)
+		}
+	}
+}
+
+func (r *Scheduler) runJob(j *job, now time.Time) {
+	r.mu.Lock()
+	j.status.Running = true
+	r.mu.Unlock()
+
+	err := j.run(now)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	j.status.Running = false
+	j.status.LastRun = now
+	j.status.LastDuration = time.Since(now)
+	j.status.Runs++
+	j.status.LastError = ""
+	if err != nil {
+		j.status.LastError = err.Error()
+		logger.Printf("job %s: %s", j.status.Name, err.Error())
+	}
+}
+
+// stop scheduling and wait for running jobs to finish
+func (r *Scheduler) Stop() {
+	r.mu.Lock()
+	if !r.started {
+		r.mu.Unlock()
+		return
+	}
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+// status of all jobs in the order they are added
+func (r *Scheduler) Status() []JobStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := make([]JobStatus, len(r.jobs))
+	for i, j := range r.jobs {
+		status[i] = j.status
+	}
+	return status
+}
+
+var SchedulerInstance = NewScheduler()
@@ -0,0 +1,184 @@
+package nessielight
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func bits(values ...int) uint64 {
+	var set uint64
+	for _, v := range values {
+		set |= 1 << uint(v)
+	}
+	return set
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		text     string
+		min, max int
+		want     uint64
+		err      bool
+	}{
+		{"*", 0, 5, bits(0, 1, 2, 3, 4, 5), false},
+		{"*", 1, 3, bits(1, 2, 3), false},
+		{"*/15", 0, 59, bits(0, 15, 30, 45), false},
+		{"5/15", 0, 59, bits(5, 20, 35, 50), false},
+		{"1-5", 0, 7, bits(1, 2, 3, 4, 5), false},
+		{"0,30", 0, 59, bits(0, 30), false},
+		{"9-17/2", 0, 23, bits(9, 11, 13, 15, 17), false},
+		{"1-3,10,20-21", 0, 23, bits(1, 2, 3, 10, 20, 21), false},
+		{"7", 0, 7, bits(7), false},
+		{"", 0, 59, 0, true},
+		{"a", 0, 59, 0, true},
+		{"1-a", 0, 59, 0, true},
+		{"60", 0, 59, 0, true},
+		{"0", 1, 31, 0, true},
+		{"5-1", 0, 59, 0, true},
+		{"*/0", 0, 59, 0, true},
+		{"*/-1", 0, 59, 0, true},
+		{"1,", 0, 59, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCronField(tt.text, tt.min, tt.max)
+		if (err != nil) != tt.err {
+			t.Errorf("parseCronField(%q, %d, %d) error = %v, want error %v", tt.text, tt.min, tt.max, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseCronField(%q, %d, %d) = %b, want %b", tt.text, tt.min, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		text string
+		want *cronSchedule
+	}{
+		{"0 9 * * *", &cronSchedule{minute: bits(0), hour: bits(9), dom: bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10,
+			11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31),
+			month: bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12), dow: bits(0, 1, 2, 3, 4, 5, 6, 7)}},
+		{"*/30 0  1,15 */6 *", &cronSchedule{minute: bits(0, 30), hour: bits(0), dom: bits(1, 15),
+			month: bits(1, 7), dow: bits(0, 1, 2, 3, 4, 5, 6, 7), domRestricted: true}},
+		// both 0 and 7 are sunday
+		{"0 0 * * 7", &cronSchedule{minute: bits(0), hour: bits(0), dom: bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10,
+			11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31),
+			month: bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12), dow: bits(0, 7), dowRestricted: true}},
+		{"0 0 13 * 5", &cronSchedule{minute: bits(0), hour: bits(0), dom: bits(13),
+			month: bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12), dow: bits(5), domRestricted: true, dowRestricted: true}},
+		{"", nil},
+		{"0 9 * *", nil},
+		{"0 9 * * * *", nil},
+		{"60 9 * * *", nil},
+		{"0 24 * * *", nil},
+		{"0 9 0 * *", nil},
+		{"0 9 * 13 *", nil},
+		{"0 9 * * 8", nil},
+		{"0 9 * * mon", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseCron(tt.text)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseCron(%q) = %+v, want error", tt.text, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCron(%q) error: %s", tt.text, err.Error())
+			continue
+		}
+		tt.want.text = tt.text
+		if *got != *tt.want {
+			t.Errorf("parseCron(%q) = %+v, want %+v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	const layout = "2006-01-02 15:04 MST"
+	tests := []struct {
+		name string
+		loc  string
+		expr string
+		// in loc, not ambiguous
+		from string
+		// successive runs, none if the expression never matches
+		want []string
+	}{
+		{"daily", "UTC", "0 9 * * *", "2026-01-01 08:59",
+			[]string{"2026-01-01 09:00 UTC", "2026-01-02 09:00 UTC", "2026-01-03 09:00 UTC"}},
+		{"every 15 minutes", "UTC", "*/15 * * * *", "2026-01-01 23:50",
+			[]string{"2026-01-02 00:00 UTC", "2026-01-02 00:15 UTC"}},
+		{"seconds are dropped", "UTC", "* * * * *", "2026-01-01 10:00",
+			[]string{"2026-01-01 10:01 UTC", "2026-01-01 10:02 UTC"}},
+		{"quarterly", "UTC", "0 0 1 */3 *", "2026-02-15 12:00",
+			[]string{"2026-04-01 00:00 UTC", "2026-07-01 00:00 UTC", "2026-10-01 00:00 UTC", "2027-01-01 00:00 UTC"}},
+		{"leap day", "UTC", "0 0 29 2 *", "2026-03-01 00:00",
+			[]string{"2028-02-29 00:00 UTC", "2032-02-29 00:00 UTC"}},
+		{"never", "UTC", "0 0 31 2 *", "2026-01-01 00:00", nil},
+		{"half hour offset", "Asia/Kolkata", "0 9 * * *", "2026-01-01 07:10",
+			[]string{"2026-01-01 09:00 IST", "2026-01-02 09:00 IST"}},
+		{"half hour offset hourly", "Asia/Kolkata", "0 */6 * * *", "2026-01-01 01:10",
+			[]string{"2026-01-01 06:00 IST", "2026-01-01 12:00 IST", "2026-01-01 18:00 IST", "2026-01-02 00:00 IST"}},
+		{"half hour offset in summer", "Australia/Adelaide", "0 9 * * *", "2026-01-01 07:10",
+			[]string{"2026-01-01 09:00 ACDT", "2026-01-02 09:00 ACDT"}},
+		{"half hour offset across DST end", "Australia/Adelaide", "0 9 * * *", "2026-04-04 08:00",
+			[]string{"2026-04-04 09:00 ACDT", "2026-04-05 09:00 ACST", "2026-04-06 09:00 ACST"}},
+		{"negative half hour offset on weekdays", "America/St_Johns", "30 9 * * 1-5", "2026-01-02 10:00",
+			[]string{"2026-01-05 09:30 NST", "2026-01-06 09:30 NST"}},
+		{"hourly across DST start", "America/New_York", "0 * * * *", "2026-03-08 00:30",
+			[]string{"2026-03-08 01:00 EST", "2026-03-08 03:00 EDT", "2026-03-08 04:00 EDT"}},
+		{"skipped time at DST start", "America/New_York", "30 2 * * *", "2026-03-07 03:00",
+			[]string{"2026-03-09 02:30 EDT", "2026-03-10 02:30 EDT"}},
+		{"hourly across DST end", "America/New_York", "0 * * * *", "2026-11-01 00:30",
+			[]string{"2026-11-01 01:00 EDT", "2026-11-01 01:00 EST", "2026-11-01 02:00 EST"}},
+		{"daily across DST end", "America/New_York", "0 3 * * *", "2026-11-01 00:30",
+			[]string{"2026-11-01 03:00 EST", "2026-11-02 03:00 EST"}},
+		{"skipped midnight", "America/Havana", "0 * * * *", "2026-03-07 23:30",
+			[]string{"2026-03-08 01:00 CDT", "2026-03-08 02:00 CDT"}},
+		{"daily at skipped midnight", "America/Havana", "0 0 * * *", "2026-03-07 12:00",
+			[]string{"2026-03-09 00:00 CDT"}},
+		{"half hour DST start", "Australia/Lord_Howe", "0,45 * * * *", "2026-10-04 01:10",
+			[]string{"2026-10-04 01:45 +1030", "2026-10-04 02:45 +11", "2026-10-04 03:00 +11"}},
+		// 2026-01-01 is a thursday, and 2026-01-13 a tuesday
+		{"day of month or day of week", "UTC", "0 0 13 * 5", "2026-01-01 00:00",
+			[]string{"2026-01-02 00:00 UTC", "2026-01-09 00:00 UTC", "2026-01-13 00:00 UTC", "2026-01-16 00:00 UTC"}},
+		{"day of month only", "UTC", "0 0 13 * *", "2026-01-01 00:00",
+			[]string{"2026-01-13 00:00 UTC", "2026-02-13 00:00 UTC"}},
+		{"sunday as 7", "UTC", "0 0 * * 7", "2026-01-01 00:00",
+			[]string{"2026-01-04 00:00 UTC", "2026-01-11 00:00 UTC"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := time.LoadLocation(tt.loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			schedule, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			from, err := time.ParseInLocation("2006-01-02 15:04", tt.from, loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// seconds within the minute do not matter
+			next := from.Add(30 * time.Second)
+			for _, want := range tt.want {
+				prev := next
+				next = schedule.Next(next)
+				if got := next.Format(layout); got != want {
+					t.Fatalf("Next(%s) = %s, want %s", prev.Format(layout), got, want)
+				}
+			}
+			if len(tt.want) == 0 {
+				if next = schedule.Next(next); !next.IsZero() {
+					t.Errorf("Next(%s) = %s, want zero", from.Format(layout), next.Format(layout))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package nessielight
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	core "github.com/v2fly/v2ray-core/v4"
+	"github.com/v2fly/v2ray-core/v4/app/proxyman"
+	"github.com/v2fly/v2ray-core/v4/app/proxyman/command"
+	"github.com/v2fly/v2ray-core/v4/common/net"
+	"github.com/v2fly/v2ray-core/v4/common/protocol"
+	"github.com/v2fly/v2ray-core/v4/common/serial"
+	"github.com/v2fly/v2ray-core/v4/proxy/shadowsocks"
+	"gorm.io/gorm"
+)
+
+// AEAD ciphers supported by v2ray, named as in SIP002
+var ssCiphers = map[string]shadowsocks.CipherType{
+	"aes-128-gcm":            shadowsocks.CipherType_AES_128_GCM,
+	"aes-256-gcm":            shadowsocks.CipherType_AES_256_GCM,
+	"chacha20-ietf-poly1305": shadowsocks.CipherType_CHACHA20_POLY1305,
+}
+
+// shadowsocks inbound of v2ray accepts only one user, so every proxy owns an inbound
+func (r *v2rayClient) AddShadowsocksInbound(tag string, port uint16, email, cipher, password string) error {
+	cipherType, ok := ssCiphers[cipher]
+	if !ok {
+		return fmt.Errorf("unknown shadowsocks cipher %s", cipher)
+	}
+	_, err := r.handClient.AddInbound(context.Background(), &command.AddInboundRequest{
+		Inbound: &core.InboundHandlerConfig{
+			Tag: tag,
+			ReceiverSettings: serial.ToTypedMessage(&proxyman.ReceiverConfig{
+				PortRange: net.SinglePortRange(net.Port(port)),
+				Listen:    net.NewIPOrDomain(net.ParseAddress(r.ssListen)),
+			}),
+			ProxySettings: serial.ToTypedMessage(&shadowsocks.ServerConfig{
+				User: &protocol.User{
+					Level: 0,
+					Email: email,
+					Account: serial.ToTypedMessage(&shadowsocks.Account{
+						Password:   password,
+						CipherType: cipherType,
+					}),
+				},
+				Network: []net.Network{net.Network_TCP, net.Network_UDP},
+			}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	logger.Printf("successfully add shadowsocks inbound %s, port=%d, cipher=%s", tag, port, cipher)
+	return nil
+}
+
+// generate SIP002 ss link
+func (r *v2rayClient) ShadowsocksLink(id uint, port uint16, cipher, password string) string {
+	userinfo := b64.RawURLEncoding.EncodeToString([]byte(cipher + ":" + password))
+	link := "ss://" + userinfo + "@" + fmt.Sprintf("%s:%d", r.domain, port)
+	if r.ssPlugin != "" {
+		link += "/?plugin=" + url.QueryEscape(r.ssPlugin)
+	}
+	return link + "#" + url.PathEscape(proxyName(r.domain, "shadowsocks", id))
+}
+
+// ports allocated recently, which are not yet found in users until the new
+// proxy is saved with its user
+var (
+	ssPortMu       sync.Mutex
+	ssPortReserved = make(map[uint16]time.Time)
+)
+
+// how long an allocated port is reserved for its proxy to be given to a user
+const ssPortReserve = time.Minute
+
+// allocate a port unused by shadowsocks proxies of other users. Replaced proxies
+// are left in database, so ports are collected from users instead of the table
+func (r *v2rayClient) NewShadowsocksProxy() (Proxy, error) {
+	ssPortMu.Lock()
+	defer ssPortMu.Unlock()
+	users, err := UserManagerInstance.All()
+	if err != nil {
+		return nil, err
+	}
+	usedSet := make(map[uint16]bool)
+	for port, t := range ssPortReserved {
+		if time.Since(t) > ssPortReserve {
+			delete(ssPortReserved, port)
+		} else {
+			usedSet[port] = true
+		}
+	}
+	for _, user := range users {
+		for _, p := range user.Proxy() {
+			if ssproxy, ok := p.(*shadowsocksProxy); ok {
+				usedSet[ssproxy.Port] = true
+			}
+		}
+	}
+	for port := int(r.ssPortMin); port <= int(r.ssPortMax); port++ {
+		if !usedSet[uint16(port)] {
+			proxy := shadowsocksProxy{
+				Port:     uint16(port),
+				Cipher:   r.ssCipher,
+				Password: NewPassword(),
+			}
+			if err := DataBase.Create(&proxy).Error; err != nil {
+				return nil, err
+			}
+			ssPortReserved[proxy.Port] = time.Now()
+			return &proxy, nil
+		}
+	}
+	return nil, fmt.Errorf("no free shadowsocks port in %d-%d", r.ssPortMin, r.ssPortMax)
+}
+
+// implement Proxy
+type shadowsocksProxy struct {
+	gorm.Model
+	Port     uint16
+	Cipher   string
+	Password string
+}
+
+// also used as inbound tag
+func (r *shadowsocksProxy) email() string {
+	return proxyEmail(V2rayServiceInstance.(*v2rayClient).ssTag, r.ID)
+}
+
+// inbound tag used before emails were separated by ":", which may still hold
+// the port in a running v2ray
+func (r *shadowsocksProxy) legacyTag() string {
+	return V2rayServiceInstance.(*v2rayClient).ssTag + fmt.Sprint(r.ID)
+}
+func (r *shadowsocksProxy) inbound() string {
+	return r.email()
+}
+func (r *shadowsocksProxy) ProxyType() string {
+	return "shadowsocks"
+}
+func (r *shadowsocksProxy) ProxyID() uint {
+	return r.ID
+}
+func (r *shadowsocksProxy) Activate() error {
+	V2rayServiceInstance.RemoveInbound(r.legacyTag())
+	V2rayServiceInstance.RemoveInbound(r.email())
+	return V2rayServiceInstance.AddShadowsocksInbound(r.email(), r.Port, r.email(), r.Cipher, r.Password)
+}
+func (r *shadowsocksProxy) Deactivate() error {
+	V2rayServiceInstance.RemoveInbound(r.legacyTag())
+	return V2rayServiceInstance.RemoveInbound(r.email())
+}
+func (r *shadowsocksProxy) Message() string {
+	return "v2ray(shadowsocks): <code>" + r.Link() + "</code>"
+}
+func (r *shadowsocksProxy) Link() string {
+	return V2rayServiceInstance.ShadowsocksLink(r.ID, r.Port, r.Cipher, r.Password)
+}
+func (r *shadowsocksProxy) String() string {
+	return fmt.Sprintf("{ID=%d, Port=%d, Cipher=%s}", r.ID, r.Port, r.Cipher)
+}
+
+var _ Proxy = (*shadowsocksProxy)(nil)
@@ -0,0 +1,44 @@
+package nessielight
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewShadowsocksProxyConcurrentPorts(t *testing.T) {
+	initTestDB(t)
+	client := &v2rayClient{ssTag: "ss", ssPortMin: 20000, ssPortMax: 20007, ssCipher: "aes-128-gcm"}
+	V2rayServiceInstance = client
+	ssPortReserved = make(map[uint16]time.Time)
+
+	const n = 8
+	var wg sync.WaitGroup
+	ports := make([]uint16, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			proxy, err := client.NewShadowsocksProxy()
+			if err == nil {
+				ports[i] = proxy.(*shadowsocksProxy).Port
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[uint16]bool)
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if seen[ports[i]] {
+			t.Errorf("port %d allocated twice", ports[i])
+		}
+		seen[ports[i]] = true
+	}
+	if _, err := client.NewShadowsocksProxy(); err == nil {
+		t.Error("allocated a port out of range")
+	}
+}
@@ -0,0 +1,53 @@
+package nessielight
+
+import (
+	b64 "encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// token of the subscription url of a user, generated on first use
+func UserSubscriptionToken(user User) (string, error) {
+	if token := user.SubscriptionToken(); token != "" {
+		return token, nil
+	}
+	return ResetSubscriptionToken(user)
+}
+
+// replace the subscription token of a user, invalidating the old url
+func ResetSubscriptionToken(user User) (string, error) {
+	token := NewPassword()
+	if err := user.SetSubscriptionToken(token); err != nil {
+		return "", err
+	}
+	if err := UserManagerInstance.SetUser(user); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// share links of a user, one per line, encoded in base64 as clients like v2rayN expect
+func SubscriptionLinks(user User) string {
+	links := make([]string, 0)
+	for _, p := range user.Proxy() {
+		links = append(links, p.Link())
+	}
+	return b64.StdEncoding.EncodeToString([]byte(strings.Join(links, "\n")))
+}
+
+// value of Subscription-Userinfo header, showing traffic and quota in clients
+func SubscriptionUserinfo(user User) string {
+	traffic := user.Traffic()
+	quota := user.Quota()
+	total := quota.Total
+	if total == 0 && quota.Uplink > 0 && quota.Downlink > 0 {
+		total = quota.Uplink + quota.Downlink
+	}
+	// 0 for never expire
+	var expire int64
+	if expiry := user.Expiry(); !expiry.IsZero() {
+		expire = expiry.Unix()
+	}
+	return fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d",
+		int64(traffic.Uplink), int64(traffic.Downlink), int64(total), expire)
+}
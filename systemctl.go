@@ -0,0 +1,218 @@
+package nessielight
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// error of a failed system command, carrying its output and exit code
+type CommandError struct {
+	Command  string
+	ExitCode int
+	Output   string
+}
+
+func (r *CommandError) Error() string {
+	return fmt.Sprintf("%s exited with code %d", r.Command, r.ExitCode)
+}
+
+// run a command and collect stdout and stderr. Non-zero exit code is reported as *CommandError
+func runCommand(name string, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return out.String(), &CommandError{
+			Command:  strings.Join(append([]string{name}, args...), " "),
+			ExitCode: exitErr.ExitCode(),
+			Output:   out.String(),
+		}
+	}
+	return out.String(), err
+}
+
+// control v2ray as a systemd unit through systemctl
+// systemdService implements SystemCtlService
+type systemdService struct {
+	unit string
+}
+
+func (r *systemdService) StartV2rayServer() error {
+	_, err := runCommand("systemctl", "start", r.unit)
+	return err
+}
+
+func (r *systemdService) StopV2rayServer() error {
+	_, err := runCommand("systemctl", "stop", r.unit)
+	return err
+}
+
+func (r *systemdService) RestartV2rayServer() error {
+	_, err := runCommand("systemctl", "restart", r.unit)
+	return err
+}
+
+func (r *systemdService) V2rayServerStatus() (string, error) {
+	out, err := runCommand("systemctl", "status", "--no-pager", "--lines=5", r.unit)
+	var cmdErr *CommandError
+	// 3 means the unit is not active, which is a valid status
+	if errors.As(err, &cmdErr) && cmdErr.ExitCode == 3 {
+		return out, nil
+	}
+	return out, err
+}
+
+var _ SystemCtlService = (*systemdService)(nil)
+
+// run v2ray as a child process, for systems without systemd
+// processService implements SystemCtlService
+type processService struct {
+	mu   sync.Mutex
+	path string
+	args []string
+	cmd  *exec.Cmd
+	// closed when cmd exits
+	done    chan struct{}
+	started time.Time
+	// exit state of the last process
+	exitErr error
+}
+
+func (r *processService) StartV2rayServer() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running() {
+		return fmt.Errorf("v2ray is already running, pid=%d", r.cmd.Process.Pid)
+	}
+	cmd := exec.Command(r.path, r.args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	r.cmd, r.done, r.started, r.exitErr = cmd, done, time.Now(), nil
+	go func() {
+		err := cmd.Wait()
+		r.mu.Lock()
+		r.exitErr = err
+		r.mu.Unlock()
+		logger.Printf("v2ray process %d exited: %v", cmd.Process.Pid, err)
+		close(done)
+	}()
+	logger.Printf("v2ray process started, pid=%d", cmd.Process.Pid)
+	return nil
+}
+
+func (r *processService) StopV2rayServer() error {
+	r.mu.Lock()
+	if !r.running() {
+		r.mu.Unlock()
+		return fmt.Errorf("v2ray is not running")
+	}
+	cmd, done := r.cmd, r.done
+	r.mu.Unlock()
+
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		return err
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		logger.Printf("v2ray process %d does not exit in time, kill it", cmd.Process.Pid)
+		if err := cmd.Process.Kill(); err != nil {
+			return err
+		}
+		<-done
+	}
+	return nil
+}
+
+func (r *processService) RestartV2rayServer() error {
+	r.mu.Lock()
+	running := r.running()
+	r.mu.Unlock()
+	if running {
+		if err := r.StopV2rayServer(); err != nil {
+			return err
+		}
+	}
+	return r.StartV2rayServer()
+}
+
+func (r *processService) V2rayServerStatus() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cmd == nil {
+		return "not started", nil
+	}
+	if r.running() {
+		return fmt.Sprintf("running, pid=%d, since %s", r.cmd.Process.Pid, r.started.Format(time.RFC3339)), nil
+	}
+	return fmt.Sprintf("exited with code %d (%v)", r.cmd.ProcessState.ExitCode(), r.exitErr), nil
+}
+
+// must be called with mu held
+func (r *processService) running() bool {
+	if r.cmd == nil {
+		return false
+	}
+	select {
+	case <-r.done:
+		return false
+	default:
+		return true
+	}
+}
+
+var _ SystemCtlService = (*processService)(nil)
+
+func InitSystemdService(unit string) {
+	SystemCtlServiceInstance = &systemdService{unit: unit}
+}
+
+func InitProcessService(path string, args ...string) {
+	SystemCtlServiceInstance = &processService{path: path, args: args}
+}
+
+// re-add managed inbounds and users after v2ray restarts. v2ray may take a
+// while to open its api, so it retries for some time
+func ReloadV2ray() error {
+	client, ok := V2rayServiceInstance.(*v2rayClient)
+	if !ok {
+		return fmt.Errorf("v2ray service does not manage inbounds")
+	}
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = client.addManagedInbounds(); err == nil {
+			return Restore()
+		}
+		time.Sleep(time.Second)
+	}
+	return err
+}
+
+// stop v2ray on shutdown if it runs as a child process, which would otherwise
+// keep running and hold the ports of the next start
+func StopChildV2ray() error {
+	service, ok := SystemCtlServiceInstance.(*processService)
+	if !ok {
+		return nil
+	}
+	service.mu.Lock()
+	running := service.running()
+	service.mu.Unlock()
+	if !running {
+		return nil
+	}
+	return service.StopV2rayServer()
+}
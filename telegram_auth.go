@@ -1,40 +1,201 @@
 package nessielight
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/v2fly/v2ray-core/v4/common/uuid"
+	"gorm.io/gorm"
 )
 
 var authLog *log.Logger
 
+// username of the telegram bot, used in registration links
+var TelegramBotName string
+
+// settings applied to users registered by a token
+type UserPreset struct {
+	Quota TrafficQuota
+	// time from registration to expiry, zero for never
+	Validity time.Duration
+	Group    string
+}
+
+// options of a registration token
+type TokenOptions struct {
+	// telegram id of the admin creating the token
+	Creator int
+	// zero for never
+	ExpiresAt time.Time
+	// times the token can be used, 0 for unlimited
+	MaxUses int
+	Preset  UserPreset
+}
+
+type RegisterToken struct {
+	Token     string
+	CreatedAt time.Time
+	Uses      int
+	TokenOptions
+}
+
+// registration token stored in database, revoked tokens are soft deleted
+type registerToken struct {
+	gorm.Model
+	Token     string `gorm:"uniqueIndex"`
+	Creator   int
+	ExpiresAt time.Time
+	MaxUses   int
+	Uses      int
+	Quota     TrafficQuota `gorm:"embedded;embeddedPrefix:quota_"`
+	Validity  time.Duration
+	UserGroup string
+}
+
+// deep link registering the user in one tap, empty if TelegramBotName is unknown
+func (r RegisterToken) Link() string {
+	if TelegramBotName == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://t.me/%s?start=%s", TelegramBotName, r.Token)
+}
+
+func (r *registerToken) view() RegisterToken {
+	return RegisterToken{
+		Token:     r.Token,
+		CreatedAt: r.CreatedAt,
+		Uses:      r.Uses,
+		TokenOptions: TokenOptions{
+			Creator:   r.Creator,
+			ExpiresAt: r.ExpiresAt,
+			MaxUses:   r.MaxUses,
+			Preset:    r.preset(),
+		},
+	}
+}
+
+func (r *registerToken) preset() UserPreset {
+	return UserPreset{Quota: r.Quota, Validity: r.Validity, Group: r.UserGroup}
+}
+
+func (r *registerToken) usable(now time.Time) bool {
+	return (r.ExpiresAt.IsZero() || now.Before(r.ExpiresAt)) && (r.MaxUses == 0 || r.Uses < r.MaxUses)
+}
+
+var errTokenInvalid = errors.New("token is invalid, expired or used up")
+
 type simpleTelegramAuthService struct {
 	userManager *UserManager
-	tokenDB     map[string]bool
 }
 
-func (r *simpleTelegramAuthService) GenToken() string {
+func (r *simpleTelegramAuthService) GenToken(opt TokenOptions) (RegisterToken, error) {
 	uid := uuid.New()
-	token := uid.String()
-	r.tokenDB[token] = true
-	authLog.Printf("generate token %s", token)
-	return token
+	token := registerToken{
+		Token:     uid.String(),
+		Creator:   opt.Creator,
+		ExpiresAt: opt.ExpiresAt,
+		MaxUses:   opt.MaxUses,
+		Quota:     opt.Preset.Quota,
+		Validity:  opt.Preset.Validity,
+		UserGroup: opt.Preset.Group,
+	}
+	if err := DataBase.Create(&token).Error; err != nil {
+		return RegisterToken{}, err
+	}
+	authLog.Printf("generate token %s by %d, expires at %v, max uses %d", token.Token, opt.Creator, opt.ExpiresAt, opt.MaxUses)
+	return token.view(), nil
 }
 
 func (r *simpleTelegramAuthService) Register(token string, id int) (User, error) {
-	if !r.tokenDB[token] {
-		return nil, fmt.Errorf("token %s invalid", token)
+	var record registerToken
+	if err := DataBase.Where("token = ?", token).First(&record).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errTokenInvalid
+		}
+		return nil, err
 	}
-	delete(r.tokenDB, token)
+	if !record.usable(time.Now()) {
+		return nil, errTokenInvalid
+	}
+	var user User
+	// a use is only counted if the user is saved
+	err := DataBase.Transaction(func(tx *gorm.DB) error {
+		// a single conditional update, so concurrent registrations cannot exceed MaxUses
+		res := tx.Model(&registerToken{}).
+			Where("id = ? AND (max_uses = 0 OR uses < max_uses)", record.ID).
+			Update("uses", gorm.Expr("uses + 1"))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errTokenInvalid
+		}
+		var err error
+		user, err = r.newUserIn(tx, id, record.preset())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	authLog.Printf("user %d registered by token %s", id, token)
+	return user, nil
+}
+
+// create and save a user with preset
+func (r *simpleTelegramAuthService) newUser(id int, preset UserPreset) (User, error) {
+	return r.newUserIn(DataBase, id, preset)
+}
+
+// like newUser, but saved in db, which may be a transaction
+func (r *simpleTelegramAuthService) newUserIn(db *gorm.DB, id int, preset UserPreset) (User, error) {
 	user := (*r.userManager).NewUser(id)
-	if err := (*r.userManager).SetUser(user); err != nil {
+	if err := user.SetQuota(preset.Quota); err != nil {
+		return nil, err
+	}
+	if preset.Validity > 0 {
+		if err := user.SetExpiry(time.Now().Add(preset.Validity)); err != nil {
+			return nil, err
+		}
+	}
+	if err := user.SetGroup(preset.Group); err != nil {
+		return nil, err
+	}
+	if err := saveUser(db, user); err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
+func (r *simpleTelegramAuthService) Tokens() ([]RegisterToken, error) {
+	var records []registerToken
+	if err := DataBase.Order("id").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tokens := make([]RegisterToken, 0, len(records))
+	for _, v := range records {
+		if v.usable(now) {
+			tokens = append(tokens, v.view())
+		}
+	}
+	return tokens, nil
+}
+
+func (r *simpleTelegramAuthService) RevokeToken(token string) error {
+	res := DataBase.Where("token = ?", token).Delete(&registerToken{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("token %s not found", token)
+	}
+	authLog.Printf("revoke token %s", token)
+	return nil
+}
+
 func init() {
 	authLog = log.New(os.Stderr, "[auth] ", log.LstdFlags|log.Lmsgprefix)
 }
@@ -0,0 +1,118 @@
+package tgolf
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+
+	"github.com/yanzay/tbot/v2"
+)
+
+// 按钮回调及其鉴权
+type callback struct {
+	init    func(from *tbot.User, chat tbot.Chat) bool
+	handler CallbackHandler
+}
+
+// data: 按扭的 CallbackData。init 与 Register 的 init 相同，在 handler 前检查（例如权限），
+// 返回 false 则以 alert 拒绝该回调。init 为 nil 则不检查
+func (r *Server) RegisterInlineButton(data string, init func(from *tbot.User, chat tbot.Chat) bool, handler CallbackHandler) {
+	r.callbacks[data] = callback{init: init, handler: handler}
+}
+
+// prefix: CallbackData 的前缀，用于携带参数的按钮（例如 prefix + id），参数由 handler 自行从
+// cq.Data 中截取。完全匹配的按钮优先
+func (r *Server) RegisterInlineButtonPrefix(prefix string, init func(from *tbot.User, chat tbot.Chat) bool, handler CallbackHandler) {
+	r.prefixCallbacks[prefix] = callback{init: init, handler: handler}
+}
+
+// 设置后，由 Server 发出的按钮的 CallbackData 附带与 chat 绑定的 HMAC 签名，签名不符的回调会被拒绝，
+// 因此无法伪造 CallbackData。设置前发出的按钮将失效
+func (r *Server) SetCallbackSecret(secret []byte) {
+	r.callbackSecret = secret
+}
+
+// 签名与 CallbackData 之间的分隔符
+const signSeparator = "#"
+
+func (r *Server) sign(chatid string, data string) string {
+	mac := hmac.New(sha256.New, r.callbackSecret)
+	mac.Write([]byte(chatid + "\n" + data))
+	// 72 bit，CallbackData 最长 64 字节
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:9])
+}
+
+// 校验并去掉签名
+func (r *Server) verify(chatid string, data string) (string, bool) {
+	if r.callbackSecret == nil {
+		return data, true
+	}
+	i := strings.LastIndex(data, signSeparator)
+	if i < 0 {
+		return "", false
+	}
+	data, sig := data[:i], data[i+len(signSeparator):]
+	return data, hmac.Equal([]byte(sig), []byte(r.sign(chatid, data)))
+}
+
+// 复制并签名按钮，调用者的按钮矩阵可能被共享
+func (r *Server) signBtns(chatid string, btnMatrix [][]tbot.InlineKeyboardButton) [][]tbot.InlineKeyboardButton {
+	if r.callbackSecret == nil {
+		return btnMatrix
+	}
+	signed := make([][]tbot.InlineKeyboardButton, len(btnMatrix))
+	for i, row := range btnMatrix {
+		signed[i] = make([]tbot.InlineKeyboardButton, len(row))
+		for j, btn := range row {
+			if btn.CallbackData != "" {
+				btn.CallbackData += signSeparator + r.sign(chatid, btn.CallbackData)
+			}
+			signed[i][j] = btn
+		}
+	}
+	return signed
+}
+
+// 以 alert 回应回调
+func (r *Server) answerAlert(cq *tbot.CallbackQuery, text string) {
+	if err := r.Client.AnswerCallbackQuery(cq.ID, tbot.OptText(text), tbot.OptShowAlert); err != nil {
+		logger.Print(err)
+	}
+}
+
+func (r *Server) HandleCallback(cq *tbot.CallbackQuery) {
+	logger.Printf("HandleCallback: %s, message: %s", cq.Data, cq.Message.Text)
+	data, ok := r.verify(cq.Message.Chat.ID, cq.Data)
+	if !ok {
+		logger.Printf("user %d sends callback with invalid signature: %s", cq.From.ID, cq.Data)
+		r.answerAlert(cq, "This button is invalid or expired.")
+		return
+	}
+	cb, ok := r.callbacks[data]
+	if !ok {
+		// 最长前缀匹配
+		matched := ""
+		for prefix, v := range r.prefixCallbacks {
+			if strings.HasPrefix(data, prefix) && len(prefix) > len(matched) {
+				matched, cb, ok = prefix, v, true
+			}
+		}
+	}
+	if !ok {
+		logger.Printf("user %d sends unknown callback: %s", cq.From.ID, data)
+		r.answerAlert(cq, "This button is invalid or expired.")
+		return
+	}
+	if cb.init != nil && !cb.init(cq.From, cq.Message.Chat) {
+		logger.Printf("user %d is not authorized for callback %s", cq.From.ID, data)
+		r.answerAlert(cq, "Permission denied.")
+		return
+	}
+	// handler 看到的是去掉签名的 CallbackData
+	cq.Data = data
+	if err := cb.handler(cq); err != nil {
+		r.Sendf(cq.Message.Chat.ID, "[callback error]: %s", err.Error())
+		logger.Print(err)
+	}
+}
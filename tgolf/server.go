@@ -2,10 +2,18 @@
 package tgolf
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/yanzay/tbot/v2"
 )
@@ -22,6 +30,8 @@ type Command struct {
 	Param    []Parameter
 	Callback func(argv []Argument, from *tbot.User, chatid string)
 	Handler  func(*tbot.Message)
+	// 匹配触发命令的消息
+	pattern *regexp.Regexp
 }
 
 type CallbackHandler = func(*tbot.CallbackQuery) error
@@ -32,7 +42,13 @@ type Server struct {
 	Client    *tbot.Client
 	db        KVDatabase
 	commands  map[string]*Command
-	callbacks map[string]CallbackHandler
+	callbacks map[string]callback
+	// 按前缀匹配的回调，CallbackData 的剩余部分作为参数
+	prefixCallbacks map[string]callback
+	// HMAC key of callback data, nil for unsigned
+	callbackSecret []byte
+	// bot token，用于 tbot 未提供的 API，NewServerFromTbot 创建时为空
+	token string
 }
 
 // Send formatted message to a chat with html parsing
@@ -43,12 +59,51 @@ func (r *Server) Sendf(chatid string, format string, v ...interface{}) (*tbot.Me
 // Send message with inline button
 func (r *Server) SendfWithBtn(chatid string, btnMatrix [][]tbot.InlineKeyboardButton, format string, v ...interface{}) (*tbot.Message, error) {
 	btns := &tbot.InlineKeyboardMarkup{
-		InlineKeyboard: btnMatrix,
+		InlineKeyboard: r.signBtns(chatid, btnMatrix),
 	}
 	return r.Client.SendMessage(chatid, fmt.Sprintf(format, v...),
 		tbot.OptInlineKeyboardMarkup(btns), tbot.OptParseModeHTML)
 }
 
+// tbot 未提供 copyMessage，直接请求的超时时间
+var apiClient = &http.Client{Timeout: time.Minute}
+
+// bot api 地址，测试时替换
+var apiBaseURL = "https://api.telegram.org"
+
+// 与 Client.ForwardMessage 相同，但不显示 "Forwarded from"
+func (r *Server) CopyMessage(chatid string, fromChatID string, messageID int) error {
+	if r.token == "" {
+		return errors.New("copyMessage requires a server created by NewServer")
+	}
+	resp, err := apiClient.PostForm(apiBaseURL+"/bot"+r.token+"/copyMessage", url.Values{
+		"chat_id":      {chatid},
+		"from_chat_id": {fromChatID},
+		"message_id":   {strconv.Itoa(messageID)},
+	})
+	if err != nil {
+		// url.Error 包含带 token 的请求地址，不能出现在日志与回复中
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("unable to copy message: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	var apiResp struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return fmt.Errorf("unable to decode copyMessage response: %s", err.Error())
+	}
+	if !apiResp.OK {
+		// 与 tbot 的错误一致，例如 "Forbidden: bot was blocked by the user"
+		return errors.New(apiResp.Description)
+	}
+	return nil
+}
+
 // starter 为命令的触发字符串。若开头为 / 则会作为显示命令，否则为隐式命令。
 // description 可选，用于描述命令。开头为 / 的命令会以 start - description 的形式打印到日志中，方便在
 // Bot Father 那 setcommand。init 指在触发 start 后，获取参数前的检查（例如权限），返回值为
@@ -86,6 +141,25 @@ func (r *Server) Register(starter string, description string, init func(from *tb
 
 		logger.Printf("user %d invoke %s", from.ID, starter)
 
+		// 命令后附带的参数（例如 deep link 的 /start payload）依次填充，多余的部分并入最后一个参数，
+		// 校验失败则从该参数开始询问
+		args := inlineArgs(starter, text)
+		if len(argv) > 0 && len(args) > len(argv) {
+			args = append(args[:len(argv)-1], strings.Join(args[len(argv)-1:], " "))
+		}
+		for _, v := range args {
+			if current == len(argv) {
+				break
+			}
+			if argv[current].Validator != nil && !argv[current].Validator(v) {
+				r.Sendf(chat.ID, "invalid argument %s. try again", argv[current].Key)
+				break
+			}
+			argv[current].Value = v
+			argv[current].Message = m
+			current = current + 1
+		}
+
 		if current == len(argv) {
 			f(argv, from, chat.ID)
 			return
@@ -102,6 +176,7 @@ func (r *Server) Register(starter string, description string, init func(from *tb
 			}
 			if argv[current].Validator == nil || argv[current].Validator(m.Text) {
 				argv[current].Value = m.Text
+				argv[current].Message = m
 				current = current + 1
 				if current == len(argv) {
 					f(argv, m.From, m.Chat.ID)
@@ -117,8 +192,6 @@ func (r *Server) Register(starter string, description string, init func(from *tb
 
 		r.db.Set(fmt.Sprintf("user/%d", from.ID), mhandler)
 	}
-	r.Bot.HandleMessage(starter, handler)
-
 	r.commands[starter] = &Command{
 		BotCommand: tbot.BotCommand{
 			Command:     starter,
@@ -128,26 +201,28 @@ func (r *Server) Register(starter string, description string, init func(from *tb
 		Param:    params,
 		Callback: f,
 		Handler:  handler,
+		// 仅匹配开头的整个命令，以免 "/register" 匹配 "/registerx" 或文中的命令
+		pattern: regexp.MustCompile(`^` + regexp.QuoteMeta(starter) + `(@\w+)?(\s|$)`),
 	}
 }
 
-// data: 按扭的 CallbackData
-func (r *Server) RegisterInlineButton(data string, handler CallbackHandler) {
-	r.callbacks[data] = handler
-}
-
-func (r *Server) HandleCallback(cq *tbot.CallbackQuery) {
-	logger.Printf("HandleCallback: %s, message: %s", cq.Data, cq.Message.Text)
-	data := cq.Data
-	if r.callbacks[data] != nil {
-		err := r.callbacks[data](cq)
-		if err != nil {
-			r.Sendf(cq.Message.Chat.ID, "[callback error]: %s", err.Error())
-			logger.Print(err)
-		}
+// 命令文本中 starter 之后以空白分隔的参数，忽略群组中 /cmd@bot 的 bot 名
+func inlineArgs(starter string, text string) []string {
+	i := strings.Index(text, starter)
+	if i < 0 {
+		return nil
 	}
+	rest := text[i+len(starter):]
+	if strings.HasPrefix(rest, "@") {
+		rest = strings.TrimLeftFunc(rest, func(r rune) bool { return !unicode.IsSpace(r) })
+	} else if rest != "" && !unicode.IsSpace([]rune(rest)[0]) {
+		// 另一个命令，例如 /register 之于 /registerx
+		return nil
+	}
+	return strings.Fields(rest)
 }
 
+// 正在输入参数的用户的消息都作为参数（包括 /cancel 和以命令开头的文本），否则按命令分发
 func (r *Server) HandleMessage(m *tbot.Message) {
 	logger.Printf("receive message: %s \"%s\"", m.Chat.Title, m.Text)
 	if m.From != nil {
@@ -156,10 +231,19 @@ func (r *Server) HandleMessage(m *tbot.Message) {
 			if typedhandler(m) {
 				r.db.Set(fmt.Sprintf("user/%d", m.From.ID), nil)
 			}
-		} else {
-			r.Sendf(m.Chat.ID, "I can't understand >_<")
+			return
+		}
+	}
+	// 命令的 pattern 互不重叠，至多匹配一个
+	for _, v := range r.commands {
+		if v.pattern.MatchString(m.Text) {
+			v.Handler(m)
+			return
 		}
 	}
+	if m.From != nil {
+		r.Sendf(m.Chat.ID, "I can't understand >_<")
+	}
 }
 
 func (r *Server) Start() error {
@@ -181,13 +265,16 @@ func (r *Server) Start() error {
 	}
 	logger.Print(commandlist)
 
-	if err := r.Bot.Start(); err != nil {
-		return err
-	}
+	// Bot.Start 阻塞至 Stop，因此先设置命令
 	if err := r.Client.SetMyCommands(commands); err != nil {
 		return err
 	}
-	return nil
+	return r.Bot.Start()
+}
+
+// 停止接收更新，使 Start 返回
+func (r *Server) Stop() {
+	r.Bot.Stop()
 }
 
 func (r *Server) StartCommand(starter string, from *tbot.User, chat tbot.Chat) error {
@@ -208,7 +295,7 @@ func (r *Server) EditCallbackBtn(cq *tbot.CallbackQuery, btnMatrix [][]tbot.Inli
 	chatid := cq.Message.Chat.ID
 	msgid := cq.Message.MessageID
 	return r.Client.EditMessageReplyMarkup(chatid, msgid,
-		tbot.OptInlineKeyboardMarkup(&tbot.InlineKeyboardMarkup{InlineKeyboard: btnMatrix}))
+		tbot.OptInlineKeyboardMarkup(&tbot.InlineKeyboardMarkup{InlineKeyboard: r.signBtns(chatid, btnMatrix)}))
 }
 
 func (r *Server) EditCallbackMsg(cq *tbot.CallbackQuery, format string, v ...interface{}) (*tbot.Message, error) {
@@ -222,7 +309,7 @@ func (r *Server) EditCallbackMsgWithBtn(cq *tbot.CallbackQuery, btnMatrix [][]tb
 	chatid := cq.Message.Chat.ID
 	msgid := cq.Message.MessageID
 	return r.Client.EditMessageText(chatid, msgid, fmt.Sprintf(format, v...),
-		tbot.OptParseModeHTML, tbot.OptInlineKeyboardMarkup(&tbot.InlineKeyboardMarkup{InlineKeyboard: btnMatrix}))
+		tbot.OptParseModeHTML, tbot.OptInlineKeyboardMarkup(&tbot.InlineKeyboardMarkup{InlineKeyboard: r.signBtns(chatid, btnMatrix)}))
 }
 
 func NewServerFromTbot(bot *tbot.Server) Server {
@@ -232,7 +319,9 @@ func NewServerFromTbot(bot *tbot.Server) Server {
 		db:        &db,
 		Client:    bot.Client(),
 		commands:  make(map[string]*Command),
-		callbacks: make(map[string]CallbackHandler),
+		callbacks: make(map[string]callback),
+
+		prefixCallbacks: make(map[string]callback),
 	}
 	return server
 }
@@ -247,6 +336,7 @@ func NewServer(botToken string, webhookUrl string, listen string) Server {
 		}
 	})
 	server := NewServerFromTbot(bot)
+	server.token = botToken
 	return server
 }
 
@@ -262,6 +352,8 @@ type Parameter struct {
 type Argument struct {
 	Field
 	Value string
+	// 提供该参数的消息，可用于转发或获取非文本内容。命令后附带的参数为命令消息本身
+	Message *tbot.Message
 }
 
 func NewParam(key, desc string, validator func(value string) bool) Parameter {
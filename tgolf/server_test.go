@@ -0,0 +1,137 @@
+package tgolf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/yanzay/tbot/v2"
+)
+
+// server whose bot api requests all succeed
+func newTestServer(t *testing.T) *Server {
+	return newTestServerWith(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true,"result":{}}`))
+	})
+}
+
+// server whose bot api is served by handler
+func newTestServerWith(t *testing.T, handler http.HandlerFunc) *Server {
+	api := httptest.NewServer(handler)
+	t.Cleanup(api.Close)
+	server := NewServerFromTbot(tbot.New("token", tbot.WithBaseURL(api.URL)))
+	return &server
+}
+
+func TestHandleMessage(t *testing.T) {
+	server := newTestServer(t)
+	var calls []string
+	record := func(name string) func(argv []Argument, from *tbot.User, chatid string) {
+		return func(argv []Argument, from *tbot.User, chatid string) {
+			call := name
+			for _, v := range argv {
+				call += " " + v.Value
+			}
+			calls = append(calls, call)
+		}
+	}
+	server.Register("/register", "", nil, nil, record("/register"))
+	server.Register("/registerx", "", nil, nil, record("/registerx"))
+	server.Register("/ask", "", nil, []Parameter{NewParam("text", "text", nil)}, record("/ask"))
+	server.Register(">>>hidden", "", nil, nil, record(">>>hidden"))
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"/register", "/register"},
+		{"/register token", "/register"},
+		{"/register@nessie_bot token", "/register"},
+		{"/registerx", "/registerx"},
+		{"/registery", ""},
+		{"please /register", ""},
+		{"hello", ""},
+		{">>>hidden", ">>>hidden"},
+		{"text >>>hidden", ""},
+		{"/ask hi", "/ask hi"},
+		// input of a command is read before commands are dispatched
+		{"/ask", ""},
+		{"/register now", "/ask /register now"},
+		{"/register", "/register"},
+	}
+	for _, tt := range tests {
+		calls = nil
+		server.HandleMessage(&tbot.Message{
+			From: &tbot.User{ID: 1},
+			Chat: tbot.Chat{ID: "1"},
+			Text: tt.text,
+		})
+		got := ""
+		if len(calls) > 0 {
+			got = calls[0]
+		}
+		if len(calls) > 1 || got != tt.want {
+			t.Errorf("message %q calls %q, want %q", tt.text, calls, tt.want)
+		}
+	}
+}
+
+func TestHandleCallbackUnknown(t *testing.T) {
+	var alerts []string
+	server := newTestServerWith(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/answerCallbackQuery") {
+			alerts = append(alerts, r.FormValue("text"))
+		}
+		w.Write([]byte(`{"ok":true,"result":true}`))
+	})
+	handled := false
+	server.RegisterInlineButton("a/known", nil, func(cq *tbot.CallbackQuery) error {
+		handled = true
+		return nil
+	})
+
+	server.HandleCallback(&tbot.CallbackQuery{
+		ID:      "1",
+		From:    &tbot.User{ID: 1},
+		Message: &tbot.Message{Chat: tbot.Chat{ID: "1"}},
+		Data:    "a/removed",
+	})
+	if handled {
+		t.Error("unknown callback is handled")
+	}
+	if len(alerts) != 1 || alerts[0] != "This button is invalid or expired." {
+		t.Errorf("unknown callback answers %q", alerts)
+	}
+}
+
+func TestCopyMessageError(t *testing.T) {
+	var form url.Values
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`))
+	}))
+	defer api.Close()
+	base := apiBaseURL
+	t.Cleanup(func() { apiBaseURL = base })
+	apiBaseURL = api.URL
+	server := Server{token: "123:secret"}
+
+	err := server.CopyMessage("2", "1", 42)
+	if err == nil || err.Error() != "Forbidden: bot was blocked by the user" {
+		t.Errorf("copy message returns %v", err)
+	}
+	if form.Get("chat_id") != "2" || form.Get("from_chat_id") != "1" || form.Get("message_id") != "42" {
+		t.Errorf("copy message posts %v", form)
+	}
+
+	// connection errors must not reveal the token in the request url
+	api.Close()
+	err = server.CopyMessage("2", "1", 42)
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("copy message returns %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package nessielight
+
+import (
+	"time"
+
+	"github.com/Project-Nessie/nessielight/utils"
+	"gorm.io/gorm"
+)
+
+// traffic of a user through an inbound during a period
+type trafficRecord struct {
+	ID   uint      `gorm:"primarykey"`
+	Time time.Time `gorm:"index"`
+	// telegram id of user
+	UserID  int `gorm:"index"`
+	Inbound string
+	// length of period merged by downsampling, 0 for collected deltas
+	Span time.Duration
+	TrafficValue
+}
+
+// how long traffic history is kept. Zero values keep history forever
+type TrafficHistoryConfig struct {
+	// collected deltas older than this are merged into one record per Step
+	RawRetention time.Duration
+	Step         time.Duration
+	// records older than this are deleted
+	Retention time.Duration
+}
+
+var TrafficHistory = TrafficHistoryConfig{
+	RawRetention: 48 * time.Hour,
+	Step:         time.Hour,
+}
+
+// period of buckets returned by QueryTrafficHistory
+type TrafficBucketSize int
+
+const (
+	Hourly TrafficBucketSize = iota
+	Daily
+)
+
+// start of the bucket containing t, in local time
+func (r TrafficBucketSize) start(t time.Time) time.Time {
+	t = t.In(time.Local)
+	if r == Daily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.Local)
+}
+
+func (r TrafficBucketSize) next(t time.Time) time.Time {
+	if r == Daily {
+		return t.AddDate(0, 0, 1)
+	}
+	return t.Add(time.Hour)
+}
+
+type TrafficBucket struct {
+	Start time.Time
+	TrafficValue
+}
+
+// traffic of a user between since and until, including empty buckets. tid 0 means all users
+func QueryTrafficHistory(tid int, since, until time.Time, size TrafficBucketSize) ([]TrafficBucket, error) {
+	var records []trafficRecord
+	if err := historyQuery(tid, since, until).Order("time").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	var buckets []TrafficBucket
+	for t := size.start(since); t.Before(until); t = size.next(t) {
+		buckets = append(buckets, TrafficBucket{Start: t})
+	}
+	i := 0
+	for _, v := range records {
+		for i+1 < len(buckets) && !v.Time.Before(buckets[i+1].Start) {
+			i++
+		}
+		if i < len(buckets) {
+			buckets[i].Uplink += v.Uplink
+			buckets[i].Downlink += v.Downlink
+		}
+	}
+	return buckets, nil
+}
+
+// total traffic of a user between since and until. tid 0 means all users
+func SumTrafficHistory(tid int, since, until time.Time) (TrafficValue, error) {
+	var sum TrafficValue
+	err := historyQuery(tid, since, until).
+		Select("COALESCE(SUM(uplink), 0) AS uplink, COALESCE(SUM(downlink), 0) AS downlink").
+		Scan(&sum).Error
+	return sum, err
+}
+
+// traffic between since and until grouped by user and by inbound
+func GroupTrafficHistory(since, until time.Time) (byUser map[int]TrafficValue, byInbound map[string]TrafficValue, err error) {
+	var records []trafficRecord
+	if err := historyQuery(0, since, until).Find(&records).Error; err != nil {
+		return nil, nil, err
+	}
+	byUser = make(map[int]TrafficValue)
+	byInbound = make(map[string]TrafficValue)
+	for _, v := range records {
+		u := byUser[v.UserID]
+		u.Uplink += v.Uplink
+		u.Downlink += v.Downlink
+		byUser[v.UserID] = u
+		i := byInbound[v.Inbound]
+		i.Uplink += v.Uplink
+		i.Downlink += v.Downlink
+		byInbound[v.Inbound] = i
+	}
+	return byUser, byInbound, nil
+}
+
+func historyQuery(tid int, since, until time.Time) *gorm.DB {
+	query := DataBase.Model(&trafficRecord{}).Where("time >= ? AND time < ?", since, until)
+	if tid != 0 {
+		query = query.Where("user_id = ?", tid)
+	}
+	return query
+}
+
+type historyKey struct {
+	userID  int
+	inbound string
+}
+
+// downsample and expire traffic history according to TrafficHistory
+func CompactTrafficHistory() error {
+	now := time.Now()
+	if TrafficHistory.RawRetention > 0 && TrafficHistory.Step > 0 {
+		var records []trafficRecord
+		cutoff := now.Add(-TrafficHistory.RawRetention).Truncate(TrafficHistory.Step)
+		if err := DataBase.Where("time < ? AND span < ?", cutoff, TrafficHistory.Step).Find(&records).Error; err != nil {
+			return err
+		}
+		if len(records) > 0 {
+			type key struct {
+				historyKey
+				start time.Time
+			}
+			merged := make(map[key]*trafficRecord)
+			ids := make([]uint, 0, len(records))
+			for _, v := range records {
+				ids = append(ids, v.ID)
+				k := key{historyKey{v.UserID, v.Inbound}, v.Time.Truncate(TrafficHistory.Step)}
+				if merged[k] == nil {
+					merged[k] = &trafficRecord{Time: k.start, UserID: v.UserID, Inbound: v.Inbound, Span: TrafficHistory.Step}
+				}
+				merged[k].Uplink += v.Uplink
+				merged[k].Downlink += v.Downlink
+			}
+			rows := utils.Flatten(merged, func(v *trafficRecord) trafficRecord {
+				return *v
+			})
+			err := DataBase.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Delete(&trafficRecord{}, ids).Error; err != nil {
+					return err
+				}
+				return tx.Create(&rows).Error
+			})
+			if err != nil {
+				return err
+			}
+			logger.Printf("CompactTrafficHistory: merged %d records into %d", len(records), len(rows))
+		}
+	}
+	if TrafficHistory.Retention > 0 {
+		res := DataBase.Where("time < ?", now.Add(-TrafficHistory.Retention)).Delete(&trafficRecord{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected > 0 {
+			logger.Printf("CompactTrafficHistory: deleted %d expired records", res.RowsAffected)
+		}
+	}
+	return nil
+}
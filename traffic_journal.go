@@ -0,0 +1,150 @@
+package nessielight
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Project-Nessie/nessielight/utils"
+	"gorm.io/gorm"
+)
+
+// a user stat queried from v2ray but not yet applied to users. Counters of
+// v2ray are reset by the query, so entries are kept until applied in the same
+// transaction as traffic of users, and replayed after a crash
+type trafficJournal struct {
+	ID   uint `gorm:"primarykey"`
+	Time time.Time
+	// email of the v2ray user
+	Email string
+	// "uplink" or "downlink"
+	Link  string
+	Value int64
+}
+
+// serializes traffic collection and billing resets, which both change
+// traffic of users
+var trafficMu sync.Mutex
+
+// stats which failed to be written to the journal, retried by next collection
+var unjournaled []trafficJournal
+
+// query and reset user stats of v2ray, and add them to traffic of users and
+// traffic history
+func V2rayUpdateUserTraffic() error {
+	trafficMu.Lock()
+	defer trafficMu.Unlock()
+	stats, err := V2rayServiceInstance.QueryUserTraffic(true)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, v := range stats {
+		if v.Value == 0 {
+			continue
+		}
+		_, name, linktype := trafficNameMatch(v.Name)
+		logger.Print("V2rayUpdateUserTraffic ", name, " ", linktype, " ", utils.ByteValue(v.Value))
+		unjournaled = append(unjournaled, trafficJournal{Time: now, Email: name, Link: linktype, Value: v.Value})
+	}
+	if len(unjournaled) > 0 {
+		if err := DataBase.Create(&unjournaled).Error; err != nil {
+			for i := range unjournaled {
+				unjournaled[i].ID = 0
+			}
+			return fmt.Errorf("write traffic journal: %s", err.Error())
+		}
+		unjournaled = nil
+	}
+	return applyTrafficJournal()
+}
+
+// apply traffic left in the journal by a crash. Should be called on startup
+// after InitV2rayService, since emails of proxies depend on it
+func ReplayTrafficJournal() error {
+	trafficMu.Lock()
+	defer trafficMu.Unlock()
+	return applyTrafficJournal()
+}
+
+// add all journal entries to users and history in one transaction, and
+// remove them. trafficMu must be held
+func applyTrafficJournal() error {
+	var entries []trafficJournal
+	if err := DataBase.Order("id").Find(&entries).Error; err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	users, err := UserManagerInstance.All()
+	if err != nil {
+		return err
+	}
+	// email -> telegram id and inbound tag
+	emailIndex := make(map[string]historyKey)
+	for _, user := range users {
+		for _, p := range user.Proxy() {
+			if emailer, ok := p.(v2rayEmailer); ok {
+				emailIndex[emailer.email()] = historyKey{user.TelegramID(), emailer.inbound()}
+			}
+		}
+	}
+	type recordKey struct {
+		historyKey
+		time int64
+	}
+	totals := make(map[int]*TrafficValue)
+	records := make(map[recordKey]*trafficRecord)
+	ids := make([]uint, 0, len(entries))
+	for _, v := range entries {
+		ids = append(ids, v.ID)
+		key, ok := emailIndex[v.Email]
+		if !ok {
+			logger.Print("V2rayUpdateUserTraffic unknown email: ", v.Email)
+			continue
+		}
+		rk := recordKey{key, v.Time.UnixNano()}
+		if records[rk] == nil {
+			records[rk] = &trafficRecord{Time: v.Time, UserID: key.userID, Inbound: key.inbound}
+		}
+		if totals[key.userID] == nil {
+			totals[key.userID] = &TrafficValue{}
+		}
+		if v.Link == "downlink" {
+			records[rk].Downlink += utils.ByteValue(v.Value)
+			totals[key.userID].Downlink += utils.ByteValue(v.Value)
+		} else if v.Link == "uplink" {
+			records[rk].Uplink += utils.ByteValue(v.Value)
+			totals[key.userID].Uplink += utils.ByteValue(v.Value)
+		}
+	}
+	rows := utils.Flatten(records, func(v *trafficRecord) trafficRecord {
+		return *v
+	})
+	err = DataBase.Transaction(func(tx *gorm.DB) error {
+		for tid, v := range totals {
+			// increment in place, so traffic is not overwritten by stale users
+			err := tx.Model(&simpleUser{}).Where("registerid = ?", tid).Updates(map[string]interface{}{
+				"uplink":   gorm.Expr("uplink + ?", v.Uplink),
+				"downlink": gorm.Expr("downlink + ?", v.Downlink),
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		if len(rows) > 0 {
+			if err := tx.Create(&rows).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&trafficJournal{}, ids).Error
+	})
+	if err != nil {
+		return fmt.Errorf("apply traffic journal: %s", err.Error())
+	}
+	for tid, v := range totals {
+		logger.Printf("V2rayUpdateUserTraffic user %d: %v", tid, *v)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package nessielight
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// open a temp database and a v2ray client without connections, restored
+// after the test
+func initTestDB(t *testing.T) {
+	t.Helper()
+	db, v2ray := DataBase, V2rayServiceInstance
+	t.Cleanup(func() {
+		DataBase, V2rayServiceInstance = db, v2ray
+	})
+	if err := InitDBwithFile(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	V2rayServiceInstance = &v2rayClient{inboundTag: "vmess"}
+}
+
+func TestApplyTrafficJournal(t *testing.T) {
+	initTestDB(t)
+	proxy := &v2rayProxy{Uuid: "7d5d4a35-6bda-4c4c-8c5b-3b3e5a1c2f01"}
+	if err := DataBase.Create(proxy).Error; err != nil {
+		t.Fatal(err)
+	}
+	user := UserManagerInstance.NewUser(1001)
+	if err := user.SetProxy([]Proxy{proxy}); err != nil {
+		t.Fatal(err)
+	}
+	if err := UserManagerInstance.SetUser(user); err != nil {
+		t.Fatal(err)
+	}
+	// SetUser never writes traffic, so set it like collection does
+	if err := DataBase.Model(&simpleUser{}).Where("registerid = ?", 1001).
+		Updates(map[string]interface{}{"uplink": 100, "downlink": 1000}).Error; err != nil {
+		t.Fatal(err)
+	}
+	stale, err := UserManagerInstance.FindUserByTelegramID(1001)
+	if err != nil || stale == nil {
+		t.Fatalf("find user: %v %v", stale, err)
+	}
+
+	t1 := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+	email := proxyEmail("vmess", proxy.ID)
+	entries := []trafficJournal{
+		{Time: t1, Email: email, Link: "uplink", Value: 10},
+		{Time: t1, Email: email, Link: "downlink", Value: 20},
+		{Time: t2, Email: email, Link: "uplink", Value: 5},
+		{Time: t2, Email: "vmess:999", Link: "downlink", Value: 7},
+	}
+	if err := DataBase.Create(&entries).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := applyTrafficJournal(); err != nil {
+		t.Fatal(err)
+	}
+	// the copy loaded before collection must not overwrite traffic
+	if err := UserManagerInstance.SetUser(stale); err != nil {
+		t.Fatal(err)
+	}
+
+	want := TrafficValue{Uplink: 115, Downlink: 1020}
+	check := func() {
+		t.Helper()
+		user, err := UserManagerInstance.FindUserByTelegramID(1001)
+		if err != nil || user == nil {
+			t.Fatalf("find user: %v %v", user, err)
+		}
+		if got := user.Traffic(); got != want {
+			t.Errorf("traffic = %+v, want %+v", got, want)
+		}
+		var count int64
+		if err := DataBase.Model(&trafficJournal{}).Count(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("%d journal entries left", count)
+		}
+		var records []trafficRecord
+		if err := DataBase.Order("time").Find(&records).Error; err != nil {
+			t.Fatal(err)
+		}
+		wantRecords := []TrafficValue{{Uplink: 10, Downlink: 20}, {Uplink: 5}}
+		if len(records) != len(wantRecords) {
+			t.Fatalf("%d traffic records, want %d", len(records), len(wantRecords))
+		}
+		for i, v := range records {
+			if v.UserID != 1001 || v.Inbound != "vmess" || v.TrafficValue != wantRecords[i] {
+				t.Errorf("record %d = %+v, want user 1001, inbound vmess, %+v", i, v, wantRecords[i])
+			}
+		}
+	}
+	check()
+
+	// applying an empty journal changes nothing
+	if err := applyTrafficJournal(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
@@ -0,0 +1,295 @@
+package nessielight
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/v2fly/v2ray-core/v4/app/proxyman"
+	"github.com/v2fly/v2ray-core/v4/common/net"
+	"github.com/v2fly/v2ray-core/v4/common/serial"
+	"github.com/v2fly/v2ray-core/v4/transport/internet"
+	"github.com/v2fly/v2ray-core/v4/transport/internet/grpc"
+	"github.com/v2fly/v2ray-core/v4/transport/internet/headers/http"
+	"github.com/v2fly/v2ray-core/v4/transport/internet/headers/noop"
+	"github.com/v2fly/v2ray-core/v4/transport/internet/headers/srtp"
+	dtls "github.com/v2fly/v2ray-core/v4/transport/internet/headers/tls"
+	"github.com/v2fly/v2ray-core/v4/transport/internet/headers/utp"
+	"github.com/v2fly/v2ray-core/v4/transport/internet/headers/wechat"
+	"github.com/v2fly/v2ray-core/v4/transport/internet/headers/wireguard"
+	http2 "github.com/v2fly/v2ray-core/v4/transport/internet/http"
+	"github.com/v2fly/v2ray-core/v4/transport/internet/kcp"
+	"github.com/v2fly/v2ray-core/v4/transport/internet/tcp"
+	"github.com/v2fly/v2ray-core/v4/transport/internet/websocket"
+)
+
+// describe how a managed inbound receives connections
+type InboundOptions struct {
+	Port     uint16
+	Listen   string
+	Sniffing bool
+	Transport
+}
+
+// describe stream settings of an inbound. Share links are generated from it,
+// so clients always match the server
+type Transport struct {
+	// ws, grpc, h2, tcp or kcp
+	Network string
+	// path of ws or h2, or request uri of tcp http header
+	Path string
+	// grpc service name
+	ServiceName string
+	// host of h2 or tcp http header
+	Host string
+	// tcp: none or http. kcp: none, srtp, utp, wechat-video, dtls or wireguard
+	HeaderType string
+	// kcp seed
+	Seed string
+}
+
+var kcpHeaders = map[string]*serial.TypedMessage{
+	"none":         serial.ToTypedMessage(&noop.Config{}),
+	"srtp":         serial.ToTypedMessage(&srtp.Config{}),
+	"utp":          serial.ToTypedMessage(&utp.Config{}),
+	"wechat-video": serial.ToTypedMessage(&wechat.VideoConfig{}),
+	"dtls":         serial.ToTypedMessage(&dtls.PacketConfig{}),
+	"wireguard":    serial.ToTypedMessage(&wireguard.WireguardConfig{}),
+}
+
+// parse inbound options from a spec like "network=grpc&serviceName=nessie&listen=0.0.0.0".
+// path is used if spec does not specify one. An empty spec means websocket on 127.0.0.1
+func ParseInboundOptions(spec string, port int, path string) (InboundOptions, error) {
+	if port <= 0 || port > 65535 {
+		return InboundOptions{}, fmt.Errorf("invalid port %d", port)
+	}
+	values, err := url.ParseQuery(spec)
+	if err != nil {
+		return InboundOptions{}, err
+	}
+	opt := InboundOptions{
+		Port:     uint16(port),
+		Listen:   "127.0.0.1",
+		Sniffing: true,
+		Transport: Transport{
+			Network:     "ws",
+			Path:        path,
+			ServiceName: strings.TrimPrefix(path, "/"),
+			HeaderType:  "none",
+		},
+	}
+	for key := range values {
+		value := values.Get(key)
+		switch key {
+		case "listen":
+			opt.Listen = value
+		case "sniffing":
+			if opt.Sniffing, err = strconv.ParseBool(value); err != nil {
+				return opt, fmt.Errorf("invalid sniffing %s", value)
+			}
+		case "network":
+			opt.Network = value
+		case "path":
+			opt.Path = value
+		case "serviceName":
+			opt.ServiceName = value
+		case "host":
+			opt.Host = value
+		case "header":
+			opt.HeaderType = value
+		case "seed":
+			opt.Seed = value
+		default:
+			return opt, fmt.Errorf("unknown inbound option %s", key)
+		}
+	}
+	if _, err := opt.streamConfig(); err != nil {
+		return opt, err
+	}
+	return opt, nil
+}
+
+func (r InboundOptions) receiverConfig() (*proxyman.ReceiverConfig, error) {
+	stream, err := r.streamConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyman.ReceiverConfig{
+		PortRange:      net.SinglePortRange(net.Port(r.Port)),
+		Listen:         net.NewIPOrDomain(net.ParseAddress(r.Listen)),
+		StreamSettings: stream,
+		SniffingSettings: &proxyman.SniffingConfig{
+			Enabled:             r.Sniffing,
+			DestinationOverride: []string{"http", "tls"},
+		},
+	}, nil
+}
+
+// port connected by clients. TLS transports are behind the front server on frontPort
+func (r InboundOptions) clientPort(frontPort int) int {
+	if r.tls() {
+		return frontPort
+	}
+	return int(r.Port)
+}
+
+func (r Transport) streamConfig() (*internet.StreamConfig, error) {
+	var name string
+	var settings *serial.TypedMessage
+	switch r.Network {
+	case "ws":
+		name = "websocket"
+		settings = serial.ToTypedMessage(&websocket.Config{
+			Path: r.Path,
+		})
+	case "grpc":
+		name = "gun"
+		settings = serial.ToTypedMessage(&grpc.Config{
+			Host:        r.Host,
+			ServiceName: r.ServiceName,
+		})
+	case "h2":
+		name = "http"
+		config := &http2.Config{
+			Path: r.Path,
+		}
+		if r.Host != "" {
+			config.Host = []string{r.Host}
+		}
+		settings = serial.ToTypedMessage(config)
+	case "tcp":
+		name = "tcp"
+		config := &tcp.Config{}
+		switch r.HeaderType {
+		case "", "none":
+		case "http":
+			config.HeaderSettings = serial.ToTypedMessage(r.httpHeader())
+		default:
+			return nil, fmt.Errorf("unknown tcp header %s", r.HeaderType)
+		}
+		settings = serial.ToTypedMessage(config)
+	case "kcp":
+		name = "mkcp"
+		header := kcpHeaders[r.HeaderType]
+		if r.HeaderType == "" {
+			header = kcpHeaders["none"]
+		}
+		if header == nil {
+			return nil, fmt.Errorf("unknown kcp header %s", r.HeaderType)
+		}
+		config := &kcp.Config{
+			HeaderConfig: header,
+		}
+		if r.Seed != "" {
+			config.Seed = &kcp.EncryptionSeed{Seed: r.Seed}
+		}
+		settings = serial.ToTypedMessage(config)
+	default:
+		return nil, fmt.Errorf("unknown network %s", r.Network)
+	}
+	return &internet.StreamConfig{
+		ProtocolName: name,
+		TransportSettings: []*internet.TransportConfig{{
+			ProtocolName: name,
+			Settings:     settings,
+		}},
+	}, nil
+}
+
+// obfuscate tcp as plain http
+func (r Transport) httpHeader() *http.Config {
+	path := r.Path
+	if path == "" {
+		path = "/"
+	}
+	request := &http.RequestConfig{
+		Uri: []string{path},
+	}
+	if r.Host != "" {
+		request.Header = []*http.Header{{Name: "Host", Value: []string{r.Host}}}
+	}
+	return &http.Config{
+		Request: request,
+		Response: &http.ResponseConfig{
+			Version: &http.Version{Value: "1.1"},
+			Status:  &http.Status{Code: "200", Reason: "OK"},
+			Header: []*http.Header{
+				{Name: "Content-Type", Value: []string{"application/octet-stream"}},
+				{Name: "Connection", Value: []string{"keep-alive"}},
+			},
+		},
+	}
+}
+
+// ws, grpc and h2 are served by the front server with TLS, while
+// tcp and kcp are connected directly
+func (r Transport) tls() bool {
+	return r.Network == "ws" || r.Network == "grpc" || r.Network == "h2"
+}
+
+// header type shown in share links
+func (r Transport) linkType() string {
+	switch r.Network {
+	case "grpc":
+		return "gun"
+	case "tcp", "kcp":
+		if r.HeaderType == "" {
+			return "none"
+		}
+		return r.HeaderType
+	}
+	return ""
+}
+
+// path field of vmess links, which carries service name of grpc and seed of kcp
+func (r Transport) linkPath() string {
+	switch r.Network {
+	case "grpc":
+		return r.ServiceName
+	case "kcp":
+		return r.Seed
+	}
+	return r.Path
+}
+
+// fill transport fields of vless and trojan links
+func (r Transport) linkQuery(query url.Values, domain string) {
+	if r.tls() {
+		query.Set("security", "tls")
+		query.Set("sni", domain)
+	} else {
+		query.Set("security", "none")
+	}
+	host := r.Host
+	if host == "" {
+		host = domain
+	}
+	switch r.Network {
+	case "ws":
+		query.Set("type", "ws")
+		query.Set("host", host)
+		query.Set("path", r.Path)
+	case "grpc":
+		query.Set("type", "grpc")
+		query.Set("serviceName", r.ServiceName)
+		query.Set("mode", "gun")
+	case "h2":
+		query.Set("type", "http")
+		query.Set("host", host)
+		query.Set("path", r.Path)
+	case "tcp":
+		query.Set("type", "tcp")
+		query.Set("headerType", r.linkType())
+		if r.linkType() == "http" {
+			query.Set("host", host)
+			query.Set("path", r.Path)
+		}
+	case "kcp":
+		query.Set("type", "kcp")
+		query.Set("headerType", r.linkType())
+		if r.Seed != "" {
+			query.Set("seed", r.Seed)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package nessielight
+
+import "testing"
+
+func TestParseInboundOptions(t *testing.T) {
+	defaults := InboundOptions{
+		Port:     10086,
+		Listen:   "127.0.0.1",
+		Sniffing: true,
+		Transport: Transport{
+			Network:     "ws",
+			Path:        "/ws",
+			ServiceName: "ws",
+			HeaderType:  "none",
+		},
+	}
+	with := func(f func(opt *InboundOptions)) InboundOptions {
+		opt := defaults
+		f(&opt)
+		return opt
+	}
+	tests := []struct {
+		spec string
+		port int
+		want InboundOptions
+		err  bool
+	}{
+		{"", 10086, defaults, false},
+		{"network=grpc&serviceName=nessie&listen=0.0.0.0", 10086, with(func(opt *InboundOptions) {
+			opt.Network, opt.ServiceName, opt.Listen = "grpc", "nessie", "0.0.0.0"
+		}), false},
+		{"network=h2&host=example.com&path=/h2", 10086, with(func(opt *InboundOptions) {
+			opt.Network, opt.Host, opt.Path = "h2", "example.com", "/h2"
+		}), false},
+		{"network=tcp&header=http&host=example.com", 443, with(func(opt *InboundOptions) {
+			opt.Port, opt.Network, opt.HeaderType, opt.Host = 443, "tcp", "http", "example.com"
+		}), false},
+		{"network=kcp&header=wechat-video&seed=nessie", 10086, with(func(opt *InboundOptions) {
+			opt.Network, opt.HeaderType, opt.Seed = "kcp", "wechat-video", "nessie"
+		}), false},
+		{"sniffing=false", 65535, with(func(opt *InboundOptions) {
+			opt.Port, opt.Sniffing = 65535, false
+		}), false},
+		{"", 0, InboundOptions{}, true},
+		{"", 65536, InboundOptions{}, true},
+		{"network=quic", 10086, InboundOptions{}, true},
+		{"network=tcp&header=srtp", 10086, InboundOptions{}, true},
+		{"network=kcp&header=http", 10086, InboundOptions{}, true},
+		{"sniffing=maybe", 10086, InboundOptions{}, true},
+		{"security=tls", 10086, InboundOptions{}, true},
+		{"path=%zz", 10086, InboundOptions{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseInboundOptions(tt.spec, tt.port, "/ws")
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseInboundOptions(%q, %d) = %+v, want error", tt.spec, tt.port, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseInboundOptions(%q, %d) error: %s", tt.spec, tt.port, err.Error())
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseInboundOptions(%q, %d) = %+v, want %+v", tt.spec, tt.port, got, tt.want)
+		}
+	}
+}
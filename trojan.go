@@ -0,0 +1,118 @@
+package nessielight
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	core "github.com/v2fly/v2ray-core/v4"
+	"github.com/v2fly/v2ray-core/v4/app/proxyman/command"
+	"github.com/v2fly/v2ray-core/v4/common/protocol"
+	"github.com/v2fly/v2ray-core/v4/common/serial"
+	"github.com/v2fly/v2ray-core/v4/proxy/trojan"
+	"gorm.io/gorm"
+)
+
+// TLS is terminated by the front server, so the inbound itself is plain
+func (r *v2rayClient) AddTrojanInbound(tag string, opt InboundOptions) error {
+	receiver, err := opt.receiverConfig()
+	if err != nil {
+		return err
+	}
+	_, err = r.handClient.AddInbound(context.Background(), &command.AddInboundRequest{
+		Inbound: &core.InboundHandlerConfig{
+			Tag:              tag,
+			ReceiverSettings: serial.ToTypedMessage(receiver),
+			ProxySettings: serial.ToTypedMessage(&trojan.ServerConfig{
+				Users: []*protocol.User{},
+			}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	logger.Printf("successfully add trojan inbound %s, port=%d, network=%s", tag, opt.Port, opt.Network)
+	return nil
+}
+
+func (r *v2rayClient) SetTrojanUser(email, password string) error {
+	err := r.addUser(r.trojanTag, &protocol.User{
+		Level: 0,
+		Email: email,
+		Account: serial.ToTypedMessage(&trojan.Account{
+			Password: password,
+		}),
+	})
+	if err != nil {
+		return err
+	}
+	logger.Printf("SetTrojanUser: email=%s", email)
+	return nil
+}
+
+func (r *v2rayClient) RemoveTrojanUser(email string) error {
+	if err := r.removeUser(r.trojanTag, email); err != nil {
+		return err
+	}
+	logger.Printf("RemoveTrojanUser: email=%s", email)
+	return nil
+}
+
+// generate trojan link from password
+func (r *v2rayClient) TrojanLink(id uint, password string) string {
+	query := url.Values{}
+	r.trojan.linkQuery(query, r.domain)
+	link := url.URL{
+		Scheme:   "trojan",
+		User:     url.User(password),
+		Host:     fmt.Sprintf("%s:%d", r.domain, r.trojan.clientPort(r.clientport)),
+		RawQuery: query.Encode(),
+		Fragment: proxyName(r.domain, "trojan", id),
+	}
+	return link.String()
+}
+
+func (r *v2rayClient) NewTrojanProxy() Proxy {
+	proxy := trojanProxy{
+		Password: NewPassword(),
+	}
+	DataBase.Create(&proxy)
+	return &proxy
+}
+
+// implement Proxy
+type trojanProxy struct {
+	gorm.Model
+	Password string
+}
+
+func (r *trojanProxy) email() string {
+	return proxyEmail(V2rayServiceInstance.(*v2rayClient).trojanTag, r.ID)
+}
+func (r *trojanProxy) inbound() string {
+	return V2rayServiceInstance.(*v2rayClient).trojanTag
+}
+func (r *trojanProxy) ProxyType() string {
+	return "trojan"
+}
+func (r *trojanProxy) ProxyID() uint {
+	return r.ID
+}
+func (r *trojanProxy) Activate() error {
+	V2rayServiceInstance.RemoveTrojanUser(r.email())
+	return V2rayServiceInstance.SetTrojanUser(r.email(), r.Password)
+}
+func (r *trojanProxy) Deactivate() error {
+	return V2rayServiceInstance.RemoveTrojanUser(r.email())
+}
+func (r *trojanProxy) Message() string {
+	return "v2ray(trojan): <code>" + r.Link() + "</code>"
+}
+func (r *trojanProxy) Link() string {
+	return V2rayServiceInstance.TrojanLink(r.ID, r.Password)
+}
+func (r *trojanProxy) String() string {
+	return fmt.Sprintf("{ID=%d, Password=%s}", r.ID, r.Password)
+}
+
+var _ Proxy = (*trojanProxy)(nil)
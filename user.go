@@ -2,9 +2,8 @@ package nessielight
 
 import (
 	"fmt"
+	"time"
 
-	"github.com/Project-Nessie/nessielight/utils"
-	"github.com/lib/pq"
 	"gorm.io/gorm"
 )
 
@@ -12,9 +11,32 @@ type simpleUser struct {
 	gorm.Model
 	Registerid int
 	Nam        string
-	// proxy id
-	V2rayProxyID pq.Int32Array `gorm:"type:text[]"`
-	Traff        TrafficValue  `gorm:"embedded"`
+	// proxies of any registered type
+	Proxies proxyRefList `gorm:"type:text"`
+	Traff   TrafficValue `gorm:"embedded"`
+	Limit   TrafficQuota `gorm:"embedded;embeddedPrefix:quota_"`
+	Suspend string
+	// day of month when billing cycles start, 0 for BillingCycleDay
+	Cycle      int
+	CycleBegin time.Time
+	SubToken   string        `gorm:"index"`
+	Prefs      preferenceMap `gorm:"type:text"`
+	Expire     time.Time
+	UserGroup  string
+	Note       string
+	// columns changed by setters since the user is loaded, which are the
+	// only columns saveUser writes. Other columns in db may be newer than
+	// this copy, e.g. suspension set by a scheduled job
+	changed map[string]bool `gorm:"-"`
+}
+
+func (r *simpleUser) markChanged(columns ...string) {
+	if r.changed == nil {
+		r.changed = make(map[string]bool)
+	}
+	for _, v := range columns {
+		r.changed[v] = true
+	}
 }
 
 func (r *simpleUser) TelegramID() int {
@@ -26,27 +48,34 @@ func (r *simpleUser) Name() string {
 }
 
 func (r *simpleUser) Proxy() []Proxy {
-	return utils.Map(r.V2rayProxyID, func(id int32) Proxy {
-		var v2rayproxy v2rayProxy
-		DataBase.First(&v2rayproxy, id)
-		return &v2rayproxy
-	})
+	proxies := make([]Proxy, 0, len(r.Proxies))
+	for _, ref := range r.Proxies {
+		proxy, err := LoadProxy(ref.Type, ref.ID)
+		if err != nil {
+			logger.Printf("load proxy %s:%d of user %d: %s", ref.Type, ref.ID, r.Registerid, err.Error())
+			continue
+		}
+		proxies = append(proxies, proxy)
+	}
+	return proxies
 }
 
 func (r *simpleUser) SetProxy(proxy []Proxy) error {
-	r.V2rayProxyID = make([]int32, 0, len(r.V2rayProxyID))
+	refs := make(proxyRefList, 0, len(proxy))
 	for _, v := range proxy {
-		if v2rayproxy, ok := v.(*v2rayProxy); ok {
-			r.V2rayProxyID = append(r.V2rayProxyID, int32(v2rayproxy.ID))
-		} else {
-			panic(fmt.Errorf("unknown proxy type"))
+		if _, ok := proxyTypes[v.ProxyType()]; !ok {
+			return fmt.Errorf("unknown proxy type %s", v.ProxyType())
 		}
+		refs = append(refs, proxyRef{Type: v.ProxyType(), ID: v.ProxyID()})
 	}
+	r.Proxies = refs
+	r.markChanged("proxies")
 	return nil
 }
 
 func (r *simpleUser) SetName(name string) error {
 	r.Nam = name
+	r.markChanged("nam")
 	return nil
 }
 
@@ -58,4 +87,95 @@ func (r *simpleUser) SetTraffic(val TrafficValue) error {
 	return nil
 }
 
+func (r *simpleUser) Quota() TrafficQuota {
+	return r.Limit
+}
+func (r *simpleUser) SetQuota(quota TrafficQuota) error {
+	r.Limit = quota
+	r.markChanged("quota_uplink", "quota_downlink", "quota_total")
+	return nil
+}
+
+func (r *simpleUser) Suspension() string {
+	return r.Suspend
+}
+func (r *simpleUser) SetSuspension(reason string) error {
+	r.Suspend = reason
+	r.markChanged("suspend")
+	return nil
+}
+
+func (r *simpleUser) CycleDay() int {
+	return r.Cycle
+}
+func (r *simpleUser) SetCycleDay(day int) error {
+	if day < 0 || day > 31 {
+		return fmt.Errorf("invalid cycle day %d", day)
+	}
+	r.Cycle = day
+	r.markChanged("cycle")
+	return nil
+}
+
+func (r *simpleUser) CycleStart() time.Time {
+	return r.CycleBegin
+}
+func (r *simpleUser) SetCycleStart(t time.Time) error {
+	r.CycleBegin = t
+	r.markChanged("cycle_begin")
+	return nil
+}
+
+func (r *simpleUser) SubscriptionToken() string {
+	return r.SubToken
+}
+func (r *simpleUser) SetSubscriptionToken(token string) error {
+	r.SubToken = token
+	r.markChanged("sub_token")
+	return nil
+}
+
+func (r *simpleUser) Preference(key string) string {
+	return r.Prefs[key]
+}
+func (r *simpleUser) SetPreference(key, value string) error {
+	if r.Prefs == nil {
+		r.Prefs = preferenceMap{}
+	}
+	if value == "" {
+		delete(r.Prefs, key)
+	} else {
+		r.Prefs[key] = value
+	}
+	r.markChanged("prefs")
+	return nil
+}
+
+func (r *simpleUser) Expiry() time.Time {
+	return r.Expire
+}
+func (r *simpleUser) SetExpiry(t time.Time) error {
+	r.Expire = t
+	r.markChanged("expire")
+	return nil
+}
+
+func (r *simpleUser) Group() string {
+	return r.UserGroup
+}
+func (r *simpleUser) SetGroup(group string) error {
+	r.UserGroup = group
+	r.markChanged("user_group")
+	return nil
+}
+
+func (r *simpleUser) Notes() string {
+	return r.Note
+}
+func (r *simpleUser) SetNotes(notes string) error {
+	r.Note = notes
+	r.markChanged("note")
+	return nil
+}
+
 var _ User = (*simpleUser)(nil)
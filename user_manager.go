@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/Project-Nessie/nessielight/utils"
+	"gorm.io/gorm"
 )
 
 type simpleUserManager struct {
@@ -22,10 +23,37 @@ func (r *simpleUserManager) AddUser(user User) error {
 func (r *simpleUserManager) SetUser(user User) error {
 	if userdata, ok := user.(*simpleUser); ok {
 		logger.Print("SaveUser id=", userdata.ID, " tid=", userdata.Registerid)
-		DataBase.Save(userdata)
-	} else {
+		return saveUser(DataBase, userdata)
+	}
+	return fmt.Errorf("invalid user type")
+}
+
+// save user in db, which may be a transaction
+func saveUser(db *gorm.DB, user User) error {
+	userdata, ok := user.(*simpleUser)
+	if !ok {
 		return fmt.Errorf("invalid user type")
 	}
+	// traffic is only changed by V2rayUpdateUserTraffic and ResetUserTraffic,
+	// the copy in user may be stale
+	if userdata.ID == 0 {
+		if err := db.Omit("uplink", "downlink").Save(userdata).Error; err != nil {
+			return err
+		}
+		userdata.changed = nil
+		return nil
+	}
+	if len(userdata.changed) == 0 {
+		return nil
+	}
+	columns := make([]string, 0, len(userdata.changed))
+	for v := range userdata.changed {
+		columns = append(columns, v)
+	}
+	if err := db.Model(userdata).Select(columns).Updates(userdata).Error; err != nil {
+		return err
+	}
+	userdata.changed = nil
 	return nil
 }
 
@@ -50,18 +78,29 @@ func (r *simpleUserManager) FindUserByTelegramID(tid int) (User, error) {
 	}
 	return &user, nil
 }
-func (r *simpleUserManager) FindUserByProxy(proxyid uint) (User, error) {
+func (r *simpleUserManager) FindUserByProxy(proxytype string, proxyid uint) (User, error) {
 	var users []simpleUser
 	DataBase.Find(&users)
 	for _, v := range users {
-		for _, p := range v.V2rayProxyID {
-			if p == int32(proxyid) {
+		for _, p := range v.Proxies {
+			if p.Type == proxytype && p.ID == proxyid {
 				return &v, nil
 			}
 		}
 	}
 	return nil, nil
 }
+func (r *simpleUserManager) FindUserBySubscriptionToken(token string) (User, error) {
+	if token == "" {
+		return nil, nil
+	}
+	var user simpleUser
+	DataBase.Where(&simpleUser{SubToken: token}).First(&user)
+	if user.ID == 0 {
+		return nil, nil
+	}
+	return &user, nil
+}
 
 func (r *simpleUserManager) All() ([]User, error) {
 	var users []simpleUser
@@ -0,0 +1,50 @@
+package nessielight
+
+import "testing"
+
+func TestSetUserKeepsConcurrentChanges(t *testing.T) {
+	initTestDB(t)
+	user := UserManagerInstance.NewUser(1001)
+	if err := user.SetName("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := UserManagerInstance.SetUser(user); err != nil {
+		t.Fatal(err)
+	}
+	// copies loaded by a scheduled job and by the user editor
+	job, _ := UserManagerInstance.FindUserByTelegramID(1001)
+	editor, _ := UserManagerInstance.FindUserByTelegramID(1001)
+	if job == nil || editor == nil {
+		t.Fatal("user not found")
+	}
+
+	if err := job.SetSuspension("expired"); err != nil {
+		t.Fatal(err)
+	}
+	if err := UserManagerInstance.SetUser(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := editor.SetNotes("vip"); err != nil {
+		t.Fatal(err)
+	}
+	if err := UserManagerInstance.SetUser(editor); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := UserManagerInstance.FindUserByTelegramID(1001)
+	if got.Suspension() != "expired" || got.Notes() != "vip" || got.Name() != "alice" {
+		t.Errorf("saved user suspension=%q notes=%q name=%q", got.Suspension(), got.Notes(), got.Name())
+	}
+
+	// clearing a column is saved as well
+	if err := editor.SetSuspension(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := UserManagerInstance.SetUser(editor); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = UserManagerInstance.FindUserByTelegramID(1001)
+	if got.Suspension() != "" || got.Notes() != "vip" {
+		t.Errorf("saved user suspension=%q notes=%q", got.Suspension(), got.Notes())
+	}
+}
@@ -0,0 +1,89 @@
+package nessielight
+
+import "fmt"
+
+// add a new proxy of type name to user, activated unless the user is suspended
+func AddUserProxy(user User, name string) (Proxy, error) {
+	proxy, err := NewProxyOf(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := user.SetProxy(append(user.Proxy(), proxy)); err != nil {
+		return nil, err
+	}
+	if user.Suspension() == "" {
+		if err := proxy.Activate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := UserManagerInstance.SetUser(user); err != nil {
+		return nil, err
+	}
+	logger.Printf("add proxy %s:%d to user %d", name, proxy.ProxyID(), user.TelegramID())
+	return proxy, nil
+}
+
+// deactivate and remove a proxy of user
+func RemoveUserProxy(user User, name string, id uint) error {
+	proxies := user.Proxy()
+	i := findProxy(proxies, name, id)
+	if i < 0 {
+		return fmt.Errorf("user %d has no proxy %s:%d", user.TelegramID(), name, id)
+	}
+	// proxies of suspended users are already deactivated
+	if user.Suspension() == "" {
+		if err := proxies[i].Deactivate(); err != nil {
+			return err
+		}
+	}
+	if err := user.SetProxy(append(proxies[:i], proxies[i+1:]...)); err != nil {
+		return err
+	}
+	if err := UserManagerInstance.SetUser(user); err != nil {
+		return err
+	}
+	logger.Printf("remove proxy %s:%d from user %d", name, id, user.TelegramID())
+	return nil
+}
+
+// replace a proxy of user with a new one of the same type, so the old
+// credential stops working
+func RotateUserProxy(user User, name string, id uint) (Proxy, error) {
+	proxies := user.Proxy()
+	i := findProxy(proxies, name, id)
+	if i < 0 {
+		return nil, fmt.Errorf("user %d has no proxy %s:%d", user.TelegramID(), name, id)
+	}
+	proxy, err := NewProxyOf(name)
+	if err != nil {
+		return nil, err
+	}
+	if user.Suspension() == "" {
+		if err := proxies[i].Deactivate(); err != nil {
+			return nil, err
+		}
+	}
+	proxies[i] = proxy
+	if err := user.SetProxy(proxies); err != nil {
+		return nil, err
+	}
+	if user.Suspension() == "" {
+		if err := proxy.Activate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := UserManagerInstance.SetUser(user); err != nil {
+		return nil, err
+	}
+	logger.Printf("rotate proxy %s:%d of user %d to %s:%d", name, id, user.TelegramID(), name, proxy.ProxyID())
+	return proxy, nil
+}
+
+func findProxy(proxies []Proxy, name string, id uint) int {
+	for i, v := range proxies {
+		if v.ProxyType() == name && v.ProxyID() == id {
+			return i
+		}
+	}
+	return -1
+}
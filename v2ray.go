@@ -3,22 +3,19 @@ package nessielight
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	b64 "encoding/base64"
 	"fmt"
 	"html/template"
 
 	core "github.com/v2fly/v2ray-core/v4"
-	"github.com/v2fly/v2ray-core/v4/app/proxyman"
 	"github.com/v2fly/v2ray-core/v4/app/proxyman/command"
 	statsService "github.com/v2fly/v2ray-core/v4/app/stats/command"
-	"github.com/v2fly/v2ray-core/v4/common/net"
 	"github.com/v2fly/v2ray-core/v4/common/protocol"
 	"github.com/v2fly/v2ray-core/v4/common/serial"
 	"github.com/v2fly/v2ray-core/v4/common/uuid"
 	"github.com/v2fly/v2ray-core/v4/proxy/vmess"
 	vmessInbound "github.com/v2fly/v2ray-core/v4/proxy/vmess/inbound"
-	"github.com/v2fly/v2ray-core/v4/transport/internet"
-	"github.com/v2fly/v2ray-core/v4/transport/internet/websocket"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"gorm.io/gorm"
@@ -30,33 +27,35 @@ type v2rayClient struct {
 	statClient statsService.StatsServiceClient
 	handClient command.HandlerServiceClient
 	// vmess settings
-	inboundTag       string
-	port, clientport int
-	domain           string
-	path             string
+	inboundTag string
+	vmess      InboundOptions
+	// port of the front server, connected by clients using TLS transports
+	clientport int
+	domain     string
+	// vless settings, vlessTag is empty if vless is disabled
+	vlessTag string
+	vless    InboundOptions
+	// trojan settings, trojanTag is empty if trojan is disabled
+	trojanTag string
+	trojan    InboundOptions
+	// shadowsocks settings, ssTag is the prefix of per-proxy inbound tags
+	// and is empty if shadowsocks is disabled
+	ssTag                string
+	ssListen             string
+	ssPortMin, ssPortMax uint16
+	ssCipher             string
+	ssPlugin             string
 }
 
-func (r *v2rayClient) AddVmessWsInbound(tag string, port uint16, wspath string) error {
-	_, err := r.handClient.AddInbound(context.Background(), &command.AddInboundRequest{
+func (r *v2rayClient) AddVmessInbound(tag string, opt InboundOptions) error {
+	receiver, err := opt.receiverConfig()
+	if err != nil {
+		return err
+	}
+	_, err = r.handClient.AddInbound(context.Background(), &command.AddInboundRequest{
 		Inbound: &core.InboundHandlerConfig{
-			Tag: tag,
-			ReceiverSettings: serial.ToTypedMessage(&proxyman.ReceiverConfig{
-				PortRange: net.SinglePortRange(net.Port(port)),
-				Listen:    net.NewIPOrDomain(net.LocalHostIP), // 127.0.0.1
-				StreamSettings: &internet.StreamConfig{
-					ProtocolName: "websocket",
-					TransportSettings: []*internet.TransportConfig{{
-						ProtocolName: "websocket",
-						Settings: serial.ToTypedMessage(&websocket.Config{
-							Path: wspath,
-						}),
-					}},
-				},
-				SniffingSettings: &proxyman.SniffingConfig{
-					Enabled:             true,
-					DestinationOverride: []string{"http", "tls"},
-				},
-			}),
+			Tag:              tag,
+			ReceiverSettings: serial.ToTypedMessage(receiver),
 			ProxySettings: serial.ToTypedMessage(&vmessInbound.Config{
 				User: []*protocol.User{},
 			}),
@@ -65,7 +64,7 @@ func (r *v2rayClient) AddVmessWsInbound(tag string, port uint16, wspath string)
 	if err != nil {
 		return err
 	}
-	logger.Printf("successfully add inbound %s, port=%d, path=%s", tag, port, wspath)
+	logger.Printf("successfully add inbound %s, port=%d, network=%s", tag, opt.Port, opt.Network)
 	return nil
 }
 func (r *v2rayClient) RemoveInbound(tag string) error {
@@ -79,19 +78,36 @@ func (r *v2rayClient) RemoveInbound(tag string) error {
 	return nil
 }
 
-func (r *v2rayClient) SetUser(email, id string) error {
+// add user to inbound identified by tag
+func (r *v2rayClient) addUser(tag string, user *protocol.User) error {
 	_, err := r.handClient.AlterInbound(context.Background(), &command.AlterInboundRequest{
-		Tag: r.inboundTag,
+		Tag: tag,
 		Operation: serial.ToTypedMessage(&command.AddUserOperation{
-			User: &protocol.User{
-				Level: 0,
-				Email: email,
-				Account: serial.ToTypedMessage(&vmess.Account{
-					Id:               id,
-					AlterId:          0,
-					SecuritySettings: &protocol.SecurityConfig{Type: protocol.SecurityType_AUTO},
-				}),
-			},
+			User: user,
+		}),
+	})
+	return err
+}
+
+// remove user identified by email from inbound identified by tag
+func (r *v2rayClient) removeUser(tag string, email string) error {
+	_, err := r.handClient.AlterInbound(context.Background(), &command.AlterInboundRequest{
+		Tag: tag,
+		Operation: serial.ToTypedMessage(&command.RemoveUserOperation{
+			Email: email,
+		}),
+	})
+	return err
+}
+
+func (r *v2rayClient) SetUser(email, id string) error {
+	err := r.addUser(r.inboundTag, &protocol.User{
+		Level: 0,
+		Email: email,
+		Account: serial.ToTypedMessage(&vmess.Account{
+			Id:               id,
+			AlterId:          0,
+			SecuritySettings: &protocol.SecurityConfig{Type: protocol.SecurityType_AUTO},
 		}),
 	})
 	if err != nil {
@@ -111,13 +127,7 @@ func (r *v2rayClient) AddUser(email string) (string, error) {
 }
 
 func (r *v2rayClient) RemoveUser(email string) error {
-	_, err := r.handClient.AlterInbound(context.Background(), &command.AlterInboundRequest{
-		Tag: r.inboundTag,
-		Operation: serial.ToTypedMessage(&command.RemoveUserOperation{
-			Email: email,
-		}),
-	})
-	if err != nil {
+	if err := r.removeUser(r.inboundTag, email); err != nil {
 		return err
 	}
 	logger.Printf("RemoveUser: email=%s", email)
@@ -156,7 +166,58 @@ func (r *v2rayClient) QueryTraffic(pattern string, reset bool) ([]V2rayTrafficSt
 
 // reset is used to determine whether resetting traffic statistics
 func (r *v2rayClient) QueryUserTraffic(reset bool) ([]V2rayTrafficStat, error) {
-	return r.QueryTraffic("user>>>"+r.inboundTag, reset)
+	// 一个 tag 可能是另一个 tag 的前缀，因此按名字合并，避免重置后丢失数据
+	values := make(map[string]int64)
+	for _, tag := range r.managedTags() {
+		stats, err := r.QueryTraffic("user>>>"+tag, reset)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range stats {
+			values[v.Name] += v.Value
+		}
+	}
+	stat := make([]V2rayTrafficStat, 0, len(values))
+	for name, value := range values {
+		stat = append(stat, V2rayTrafficStat{Name: name, Value: value})
+	}
+	return stat, nil
+}
+
+// (re)add vmess, vless and trojan inbounds. Shadowsocks inbounds are added by Restore
+func (r *v2rayClient) addManagedInbounds() error {
+	r.RemoveInbound(r.inboundTag)
+	if err := r.AddVmessInbound(r.inboundTag, r.vmess); err != nil {
+		return err
+	}
+	if r.vlessTag != "" {
+		r.RemoveInbound(r.vlessTag)
+		if err := r.AddVlessInbound(r.vlessTag, r.vless); err != nil {
+			return err
+		}
+	}
+	if r.trojanTag != "" {
+		r.RemoveInbound(r.trojanTag)
+		if err := r.AddTrojanInbound(r.trojanTag, r.trojan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tags of inbounds under control
+func (r *v2rayClient) managedTags() []string {
+	tags := []string{r.inboundTag}
+	if r.vlessTag != "" {
+		tags = append(tags, r.vlessTag)
+	}
+	if r.trojanTag != "" {
+		tags = append(tags, r.trojanTag)
+	}
+	if r.ssTag != "" {
+		tags = append(tags, r.ssTag)
+	}
+	return tags
 }
 
 // 连接 v2ray API
@@ -176,40 +237,40 @@ func (r *v2rayClient) Start(listen string) error {
 }
 
 // generate vmess link from vmessid
-func (r *v2rayClient) VmessLink(vmessid string) string {
-	if len(vmessid) < 6 {
-		vmessid = "123456"
-	}
-	o := vConfig{
-		Name:   r.domain + "_" + vmessid[:6],
-		ID:     vmessid,
-		Port:   r.clientport,
-		Domain: r.domain,
-		Path:   r.path,
-	}
+func (r *v2rayClient) VmessLink(id uint, vmessid string) string {
 	var b2 bytes.Buffer
-	VConfJson.Execute(&b2, o)
+	VConfJson.Execute(&b2, r.vmessConfig(id, vmessid))
 	str := b64.StdEncoding.EncodeToString(b2.Bytes())
 	return "vmess://" + str
 }
 
 // generate vmess proxy description from vmessid
-func (r *v2rayClient) VmessText(vmessid string) string {
-	if len(vmessid) < 6 {
-		vmessid = "123456"
-	}
-	o := vConfig{
-		Name:   r.domain + "_" + vmessid[:6],
-		ID:     vmessid,
-		Port:   r.clientport,
-		Domain: r.domain,
-		Path:   r.path,
-	}
+func (r *v2rayClient) VmessText(id uint, vmessid string) string {
 	var b bytes.Buffer
-	VConfText.Execute(&b, o)
+	VConfText.Execute(&b, r.vmessConfig(id, vmessid))
 	return b.String()
 }
 
+func (r *v2rayClient) vmessConfig(id uint, vmessid string) vConfig {
+	o := vConfig{
+		Name:    proxyName(r.domain, "vmess", id),
+		ID:      vmessid,
+		Port:    r.vmess.clientPort(r.clientport),
+		Domain:  r.domain,
+		Host:    r.vmess.Host,
+		Path:    r.vmess.linkPath(),
+		Network: r.vmess.Network,
+		Type:    r.vmess.linkType(),
+	}
+	if o.Host == "" {
+		o.Host = r.domain
+	}
+	if r.vmess.tls() {
+		o.TLS = "tls"
+	}
+	return o
+}
+
 func (r *v2rayClient) NewProxy() Proxy {
 	proxy := v2rayProxy{
 		Uuid: NewUUID(),
@@ -220,23 +281,31 @@ func (r *v2rayClient) NewProxy() Proxy {
 
 var _ V2rayService = (*v2rayClient)(nil)
 
-// vmess tls
+// vmess client config
 type vConfig struct {
 	Name   string
 	ID     string
 	Port   int
 	Domain string
-	Path   string
+	Host   string
+	// path, grpc service name or kcp seed
+	Path    string
+	Network string
+	// header type, or grpc mode
+	Type string
+	// "tls" or empty
+	TLS string
 }
 
 var VConfText = template.Must(template.New("conftext").Parse(`
 协议类型: vmess
 地址: {{.Domain}}
-伪装域名/SNI: {{.Domain}}
+伪装域名/SNI: {{.Host}}
 端口: <code>{{.Port}}</code>
 用户ID: <code>{{.ID}}</code>
-安全: tls
-传输方式: ws
+安全: {{if .TLS}}tls{{else}}none{{end}}
+传输方式: {{.Network}}{{if .Type}}
+伪装类型: {{.Type}}{{end}}
 路径: <code>{{.Path}}</code>
 `))
 
@@ -244,16 +313,16 @@ var VConfJson = template.Must(template.New("confjson").Parse(`
 {
    "add":"{{.Domain}}",
    "aid":"0",
-   "host":"{{.Domain}}",
+   "host":"{{.Host}}",
    "id":"{{.ID}}",
-   "net":"ws",
+   "net":"{{.Network}}",
    "path":"{{.Path}}",
    "port":"{{.Port}}",
    "ps":"{{.Name}}",
    "scy":"auto",
    "sni":"{{.Domain}}",
-   "tls":"tls",
-   "type":"",
+   "tls":"{{.TLS}}",
+   "type":"{{.Type}}",
    "v":"2"
 }
 `))
@@ -262,14 +331,42 @@ func NewUUID() string {
 	return protocol.NewID(uuid.New()).String()
 }
 
+// generate a random url-safe password, used by trojan and shadowsocks
+func NewPassword() string {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b64.RawURLEncoding.EncodeToString(b)
+}
+
 // implement Proxy
 type v2rayProxy struct {
 	gorm.Model
 	Uuid string
 }
 
+// proxy whose traffic is recorded by v2ray stats under its email
+type v2rayEmailer interface {
+	email() string
+	// tag of the inbound serving this proxy
+	inbound() string
+}
+
+// email of the proxy with id under inbound tag. The id never contains ":", so
+// emails of different tags and ids never collide
+func proxyEmail(tag string, id uint) string {
+	return fmt.Sprintf("%s:%d", tag, id)
+}
+
 func (r *v2rayProxy) email() string {
-	return V2rayServiceInstance.(*v2rayClient).inboundTag + fmt.Sprint(r.ID)
+	return proxyEmail(V2rayServiceInstance.(*v2rayClient).inboundTag, r.ID)
+}
+func (r *v2rayProxy) inbound() string {
+	return V2rayServiceInstance.(*v2rayClient).inboundTag
+}
+func (r *v2rayProxy) ProxyType() string {
+	return "vmess"
 }
 func (r *v2rayProxy) ProxyID() uint {
 	return r.ID
@@ -282,7 +379,10 @@ func (r *v2rayProxy) Deactivate() error {
 	return V2rayServiceInstance.RemoveUser(r.email())
 }
 func (r *v2rayProxy) Message() string {
-	return "v2ray(vmess): <code>" + V2rayServiceInstance.VmessLink(r.Uuid) + "</code>"
+	return "v2ray(vmess): <code>" + r.Link() + "</code>"
+}
+func (r *v2rayProxy) Link() string {
+	return V2rayServiceInstance.VmessLink(r.ID, r.Uuid)
 }
 func (r *v2rayProxy) String() string {
 	return fmt.Sprintf("{ID=%d, Uuid=%s}", r.ID, r.Uuid)
@@ -0,0 +1,120 @@
+package nessielight
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"time"
+)
+
+// paths of v2ray log files, empty if not configured
+var V2rayAccessLog, V2rayErrorLog string
+
+// v2ray prefixes each log line with local time in this layout
+const v2rayLogTimeLayout = "2006/01/02 15:04:05"
+
+// select lines of v2ray logs. Zero values match everything
+type LogFilter struct {
+	// emails of access log, see UserEmails
+	Emails []string
+	// level of error log, e.g. Warning
+	Level string
+	// time range of lines, inclusive
+	Since, Until time.Time
+}
+
+func (r *LogFilter) match(line string) bool {
+	if !r.Since.IsZero() || !r.Until.IsZero() {
+		if len(line) < len(v2rayLogTimeLayout) {
+			return false
+		}
+		t, err := time.ParseInLocation(v2rayLogTimeLayout, line[:len(v2rayLogTimeLayout)], time.Local)
+		if err != nil {
+			return false
+		}
+		if !r.Since.IsZero() && t.Before(r.Since) {
+			return false
+		}
+		if !r.Until.IsZero() && t.After(r.Until) {
+			return false
+		}
+	}
+	if r.Level != "" && !strings.Contains(strings.ToLower(line), "["+strings.ToLower(r.Level)+"]") {
+		return false
+	}
+	if len(r.Emails) > 0 {
+		// access log ends with "email: xxx"
+		idx := strings.LastIndex(line, "email: ")
+		if idx < 0 {
+			return false
+		}
+		email := strings.TrimSpace(line[idx+len("email: "):])
+		found := false
+		for _, v := range r.Emails {
+			if v == email {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// read matched lines of a log file, skipping the last skip lines and returning at most n
+// lines before them, oldest first. total is the number of all matched lines
+func ReadV2rayLog(path string, filter LogFilter, skip, n int) (lines []string, total int, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	// keep the last skip+n matched lines
+	size := skip + n
+	ring := make([]string, 0, size)
+	head := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !filter.match(line) {
+			continue
+		}
+		total++
+		if size == 0 {
+			continue
+		}
+		if len(ring) < size {
+			ring = append(ring, line)
+		} else {
+			ring[head] = line
+			head = (head + 1) % size
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	ordered := append(append([]string{}, ring[head:]...), ring[:head]...)
+	if len(ordered) <= skip {
+		return nil, total, nil
+	}
+	ordered = ordered[:len(ordered)-skip]
+	if len(ordered) > n {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered, total, nil
+}
+
+// emails identifying proxies of a user in v2ray stats and access log
+func UserEmails(user User) []string {
+	var emails []string
+	for _, p := range user.Proxy() {
+		if emailer, ok := p.(v2rayEmailer); ok {
+			emails = append(emails, emailer.email())
+		}
+	}
+	return emails
+}
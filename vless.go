@@ -0,0 +1,121 @@
+package nessielight
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	core "github.com/v2fly/v2ray-core/v4"
+	"github.com/v2fly/v2ray-core/v4/app/proxyman/command"
+	"github.com/v2fly/v2ray-core/v4/common/protocol"
+	"github.com/v2fly/v2ray-core/v4/common/serial"
+	"github.com/v2fly/v2ray-core/v4/proxy/vless"
+	vlessInbound "github.com/v2fly/v2ray-core/v4/proxy/vless/inbound"
+	"gorm.io/gorm"
+)
+
+func (r *v2rayClient) AddVlessInbound(tag string, opt InboundOptions) error {
+	receiver, err := opt.receiverConfig()
+	if err != nil {
+		return err
+	}
+	_, err = r.handClient.AddInbound(context.Background(), &command.AddInboundRequest{
+		Inbound: &core.InboundHandlerConfig{
+			Tag:              tag,
+			ReceiverSettings: serial.ToTypedMessage(receiver),
+			ProxySettings: serial.ToTypedMessage(&vlessInbound.Config{
+				Clients:    []*protocol.User{},
+				Decryption: "none",
+			}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	logger.Printf("successfully add vless inbound %s, port=%d, network=%s", tag, opt.Port, opt.Network)
+	return nil
+}
+
+func (r *v2rayClient) SetVlessUser(email, id string) error {
+	err := r.addUser(r.vlessTag, &protocol.User{
+		Level: 0,
+		Email: email,
+		Account: serial.ToTypedMessage(&vless.Account{
+			Id:         id,
+			Encryption: "none",
+		}),
+	})
+	if err != nil {
+		return err
+	}
+	logger.Printf("SetVlessUser: email=%s id=%s", email, id)
+	return nil
+}
+
+func (r *v2rayClient) RemoveVlessUser(email string) error {
+	if err := r.removeUser(r.vlessTag, email); err != nil {
+		return err
+	}
+	logger.Printf("RemoveVlessUser: email=%s", email)
+	return nil
+}
+
+// generate vless link from vlessid
+func (r *v2rayClient) VlessLink(id uint, vlessid string) string {
+	query := url.Values{}
+	query.Set("encryption", "none")
+	r.vless.linkQuery(query, r.domain)
+	link := url.URL{
+		Scheme:   "vless",
+		User:     url.User(vlessid),
+		Host:     fmt.Sprintf("%s:%d", r.domain, r.vless.clientPort(r.clientport)),
+		RawQuery: query.Encode(),
+		Fragment: proxyName(r.domain, "vless", id),
+	}
+	return link.String()
+}
+
+func (r *v2rayClient) NewVlessProxy() Proxy {
+	proxy := vlessProxy{
+		Uuid: NewUUID(),
+	}
+	DataBase.Create(&proxy)
+	return &proxy
+}
+
+// implement Proxy
+type vlessProxy struct {
+	gorm.Model
+	Uuid string
+}
+
+func (r *vlessProxy) email() string {
+	return proxyEmail(V2rayServiceInstance.(*v2rayClient).vlessTag, r.ID)
+}
+func (r *vlessProxy) inbound() string {
+	return V2rayServiceInstance.(*v2rayClient).vlessTag
+}
+func (r *vlessProxy) ProxyType() string {
+	return "vless"
+}
+func (r *vlessProxy) ProxyID() uint {
+	return r.ID
+}
+func (r *vlessProxy) Activate() error {
+	V2rayServiceInstance.RemoveVlessUser(r.email())
+	return V2rayServiceInstance.SetVlessUser(r.email(), r.Uuid)
+}
+func (r *vlessProxy) Deactivate() error {
+	return V2rayServiceInstance.RemoveVlessUser(r.email())
+}
+func (r *vlessProxy) Message() string {
+	return "v2ray(vless): <code>" + r.Link() + "</code>"
+}
+func (r *vlessProxy) Link() string {
+	return V2rayServiceInstance.VlessLink(r.ID, r.Uuid)
+}
+func (r *vlessProxy) String() string {
+	return fmt.Sprintf("{ID=%d, Uuid=%s}", r.ID, r.Uuid)
+}
+
+var _ Proxy = (*vlessProxy)(nil)